@@ -0,0 +1,409 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	ErrApiKeyNotFound = errors.New("api-key not found")
+	ErrApiKeyScope    = errors.New("api-key does not have the required scope")
+	ErrApiKeyInactive = errors.New("api-key is revoked or expired")
+)
+
+type ApiKeyScope string
+
+const (
+	ScopeUpload   ApiKeyScope = "upload"
+	ScopeValidate ApiKeyScope = "validate"
+	ScopeSearch   ApiKeyScope = "search"
+	ScopeInfo     ApiKeyScope = "info"
+)
+
+var AllApiKeyScopes = []ApiKeyScope{ScopeUpload, ScopeValidate, ScopeSearch, ScopeInfo}
+
+const (
+	apiKeyPrefix = "apikey:"
+	apiKeyIndex  = "apikeys"
+)
+
+// An api-key, as stored. The secret itself is never stored, only its hash.
+type ApiKey struct {
+	// Public identifier of the key, which is also the first part of the secret.
+	ID        string
+	ClientId  string
+	Label     string
+	Scopes    []ApiKeyScope
+	Salt      string
+	Hash      string
+	CreatedAt time.Time
+	ExpiresAt *time.Time `json:",omitempty"`
+	RevokedAt *time.Time `json:",omitempty"`
+}
+
+func (k ApiKey) HasScope(scope ApiKeyScope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the key can be used at the given time.
+func (k ApiKey) Active(at time.Time) bool {
+	if k.RevokedAt != nil && !at.Before(*k.RevokedAt) {
+		return false
+	}
+	if k.ExpiresAt != nil && !at.Before(*k.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+func hashApiKey(salt, secret string) string {
+	h := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Manages api-keys for clients, stored hashed in Persistence.
+//
+// Secrets are in the format '<id>.<random>', so that the key can be found without scanning all keys.
+type ApiKeyStore struct {
+	p   Persistence
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+func NewApiKeyStore(p Persistence) *ApiKeyStore {
+	return &ApiKeyStore{p: p, now: time.Now}
+}
+
+// Creates a new key. The returned secret must be handed to the client, as it cannot be retrieved later.
+func (s *ApiKeyStore) Create(clientId, label string, scopes []ApiKeyScope, expiresAt *time.Time) (string, ApiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.create(clientId, label, scopes, expiresAt)
+}
+
+// Must be called with the lock held.
+func (s *ApiKeyStore) create(clientId, label string, scopes []ApiKeyScope, expiresAt *time.Time) (string, ApiKey, error) {
+	if clientId == "" {
+		return "", ApiKey{}, errors.New("client-id is required")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", ApiKey{}, fmt.Errorf("unknown scope '%s'", scope)
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", ApiKey{}, err
+	}
+	random, err := randomHex(32)
+	if err != nil {
+		return "", ApiKey{}, err
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return "", ApiKey{}, err
+	}
+	secret := id + "." + random
+	key := ApiKey{
+		ID:        id,
+		ClientId:  clientId,
+		Label:     label,
+		Scopes:    scopes,
+		Salt:      salt,
+		Hash:      hashApiKey(salt, secret),
+		CreatedAt: s.now(),
+		ExpiresAt: expiresAt,
+	}
+	if err := s.p.Set(apiKeyPrefix+id, key); err != nil {
+		return "", key, fmt.Errorf("failed to store api-key: %w", err)
+	}
+	ids, err := s.index()
+	if err != nil {
+		return "", key, err
+	}
+	if err := s.p.Set(apiKeyIndex, append(ids, id)); err != nil {
+		return "", key, fmt.Errorf("failed to store api-key-index: %w", err)
+	}
+	return secret, key, nil
+}
+
+func validScope(scope ApiKeyScope) bool {
+	for _, s := range AllApiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ApiKeyStore) index() ([]string, error) {
+	var ids []string
+	if _, err := s.p.Get(apiKeyIndex, &ids); err != nil {
+		return nil, fmt.Errorf("failed to get api-key-index: %w", err)
+	}
+	return ids, nil
+}
+
+func (s *ApiKeyStore) Get(id string) (ApiKey, error) {
+	var key ApiKey
+	found, err := s.p.Get(apiKeyPrefix+id, &key)
+	if err != nil {
+		return key, fmt.Errorf("failed to get api-key '%s': %w", id, err)
+	}
+	if !found {
+		return key, fmt.Errorf("%w: '%s'", ErrApiKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// Lists the keys of the client, or all keys if clientId is empty, including revoked and expired keys.
+func (s *ApiKeyStore) List(clientId string) ([]ApiKey, error) {
+	s.mu.Lock()
+	ids, err := s.index()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var keys []ApiKey
+	for _, id := range ids {
+		key, err := s.Get(id)
+		if err != nil {
+			return keys, err
+		}
+		if clientId == "" || key.ClientId == clientId {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *ApiKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	key.RevokedAt = &now
+	return s.p.Set(apiKeyPrefix+id, key)
+}
+
+// Creates a new key with the same client, label and scopes, and lets the old key expire after the overlap,
+// so that clients can be updated without downtime. Returns ErrApiKeyInactive if the key is revoked or expired.
+func (s *ApiKeyStore) Rotate(id string, overlap time.Duration) (string, ApiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.Get(id)
+	if err != nil {
+		return "", ApiKey{}, err
+	}
+	if !old.Active(s.now()) {
+		return "", ApiKey{}, fmt.Errorf("%w: '%s'", ErrApiKeyInactive, id)
+	}
+	secret, key, err := s.create(old.ClientId, old.Label, old.Scopes, nil)
+	if err != nil {
+		return "", key, err
+	}
+	expires := s.now().Add(overlap)
+	if old.ExpiresAt == nil || expires.Before(*old.ExpiresAt) {
+		old.ExpiresAt = &expires
+	}
+	if err := s.p.Set(apiKeyPrefix+id, old); err != nil {
+		return secret, key, fmt.Errorf("failed to expire rotated api-key: %w", err)
+	}
+	return secret, key, nil
+}
+
+// Returns the key for the secret, if it is valid, active and belongs to the client.
+func (s *ApiKeyStore) Verify(clientId, secret string) (ApiKey, error) {
+	i := strings.Index(secret, ".")
+	if i <= 0 {
+		return ApiKey{}, fmt.Errorf("%w: malformed api-key", ErrInvalidCredentials)
+	}
+	key, err := s.Get(secret[:i])
+	if errors.Is(err, ErrApiKeyNotFound) {
+		return key, fmt.Errorf("%w: unknown api-key", ErrInvalidCredentials)
+	}
+	if err != nil {
+		return key, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashApiKey(key.Salt, secret))) != 1 || key.ClientId != clientId {
+		return key, fmt.Errorf("%w: unknown api-key", ErrInvalidCredentials)
+	}
+	if !key.Active(s.now()) {
+		return key, fmt.Errorf("%w: api-key is revoked or expired", ErrInvalidCredentials)
+	}
+	return key, nil
+}
+
+// Authenticates the ClientId and ApiKey of the AuthenticationPayload.
+func (s *ApiKeyStore) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := s.AuthenticateIdentity(r, a)
+	return err
+}
+
+// The identity is the ClientId the api-key belongs to.
+func (s *ApiKeyStore) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	if a.ClientId == "" || a.ApiKey == "" {
+		return VerifiedIdentity{}, fmt.Errorf("%w: missing client-id or api-key", ErrNoCredentials)
+	}
+	key, err := s.Verify(a.ClientId, a.ApiKey)
+	if err != nil {
+		return VerifiedIdentity{}, err
+	}
+	return VerifiedIdentity{ClientId: key.ClientId}, nil
+}
+
+// Returns an Authenticator that also requires the key to have the scope.
+func (s *ApiKeyStore) WithScope(scope ApiKeyScope) Authenticator {
+	return scopedApiKeyStore{s, scope}
+}
+
+type scopedApiKeyStore struct {
+	store *ApiKeyStore
+	scope ApiKeyScope
+}
+
+func (s scopedApiKeyStore) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := s.AuthenticateIdentity(r, a)
+	return err
+}
+
+func (s scopedApiKeyStore) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	if a.ClientId == "" || a.ApiKey == "" {
+		return VerifiedIdentity{}, fmt.Errorf("%w: missing client-id or api-key", ErrNoCredentials)
+	}
+	key, err := s.store.Verify(a.ClientId, a.ApiKey)
+	if err != nil {
+		return VerifiedIdentity{}, err
+	}
+	if !key.HasScope(s.scope) {
+		return VerifiedIdentity{}, fmt.Errorf("%w: %s '%s'", ErrInvalidCredentials, ErrApiKeyScope, s.scope)
+	}
+	return VerifiedIdentity{ClientId: key.ClientId}, nil
+}
+
+// Prints the keys as a table, without hashes.
+func PrintApiKeys(w io.Writer, keys []ApiKey) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCLIENT\tLABEL\tSCOPES\tCREATED\tEXPIRES\tREVOKED")
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, k := range keys {
+		scopes := make([]string, len(k.Scopes))
+		for i, s := range k.Scopes {
+			scopes[i] = string(s)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.ClientId, k.Label, strings.Join(scopes, ","),
+			k.CreatedAt.Format(time.RFC3339), formatTime(k.ExpiresAt), formatTime(k.RevokedAt))
+	}
+	return tw.Flush()
+}
+
+// Runs an api-key-command, for use in CLI-mode:
+//
+//	create -client <id> [-label <label>] [-scopes upload,validate] [-expires 720h]
+//	list [-client <id>]
+//	revoke <key-id>
+//	rotate [-overlap 24h] <key-id>
+func RunApiKeyCommand(s *ApiKeyStore, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("expected one of the commands: create, list, revoke, rotate")
+	}
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	switch args[0] {
+	case "create":
+		clientId := fs.String("client", "", "The client-id the key belongs to")
+		label := fs.String("label", "", "A label describing the key")
+		scopes := fs.String("scopes", "upload,validate,search,info", "Comma-separated list of scopes")
+		expires := fs.Duration("expires", 0, "Lifetime of the key. Zero means no expiry")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		var sc []ApiKeyScope
+		for _, scope := range strings.Split(*scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				sc = append(sc, ApiKeyScope(scope))
+			}
+		}
+		var expiresAt *time.Time
+		if *expires > 0 {
+			t := s.now().Add(*expires)
+			expiresAt = &t
+		}
+		secret, key, err := s.Create(*clientId, *label, sc, expiresAt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created api-key %s for client %s. The key will not be shown again:\n%s\n", key.ID, key.ClientId, secret)
+	case "list":
+		clientId := fs.String("client", "", "Only list keys for this client-id")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		keys, err := s.List(*clientId)
+		if err != nil {
+			return err
+		}
+		return PrintApiKeys(out, keys)
+	case "revoke":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("expected the id of the key to revoke")
+		}
+		if err := s.Revoke(fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked api-key %s\n", fs.Arg(0))
+	case "rotate":
+		overlap := fs.Duration("overlap", 24*time.Hour, "How long the old key stays valid")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("expected the id of the key to rotate")
+		}
+		secret, key, err := s.Rotate(fs.Arg(0), *overlap)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created api-key %s replacing %s, which expires in %s. The key will not be shown again:\n%s\n", key.ID, fs.Arg(0), *overlap, secret)
+	default:
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiKeyStore(t *testing.T) {
+	now := time.Date(2021, 5, 12, 12, 0, 0, 0, time.UTC)
+	s := NewApiKeyStore(newMemoryPersistence())
+	s.now = func() time.Time { return now }
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	secret, key, err := s.Create("watch-folder", "office", []ApiKeyScope{ScopeUpload}, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, key.ID+"."))
+	assert.NotContains(t, key.Hash, secret)
+
+	assert.NoError(t, s.Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: secret}))
+	assert.NoError(t, s.WithScope(ScopeUpload).Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: secret}))
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(s.WithScope(ScopeSearch).Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: secret})))
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(s.Authenticate(r, AuthenticationPayload{ClientId: "gateway", ApiKey: secret})))
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(s.Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: key.ID + ".wrong"})))
+	assert.Equal(t, http.StatusUnauthorized, AuthenticationStatusCode(s.Authenticate(r, AuthenticationPayload{ClientId: "watch-folder"})))
+
+	_, _, err = s.Create("watch-folder", "", []ApiKeyScope{"delete"}, nil)
+	assert.Error(t, err)
+
+	newSecret, newKey, err := s.Rotate(key.ID, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, key.Scopes, newKey.Scopes)
+	assert.NoError(t, s.Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: secret}), "the old key should be valid during the overlap")
+	now = now.Add(time.Hour)
+	assert.Error(t, s.Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: secret}))
+	assert.NoError(t, s.Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: newSecret}))
+
+	_, _, err = s.Rotate(key.ID, time.Hour)
+	assert.True(t, errors.Is(err, ErrApiKeyInactive), "expired keys cannot be rotated")
+
+	assert.NoError(t, s.Revoke(newKey.ID))
+	assert.Error(t, s.Authenticate(r, AuthenticationPayload{ClientId: "watch-folder", ApiKey: newSecret}))
+	_, _, err = s.Rotate(newKey.ID, time.Hour)
+	assert.True(t, errors.Is(err, ErrApiKeyInactive), "revoked keys cannot be rotated")
+
+	keys, err := s.List("watch-folder")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+}
+
+func TestRunApiKeyCommand(t *testing.T) {
+	s := NewApiKeyStore(newMemoryPersistence())
+	var out bytes.Buffer
+	assert.NoError(t, RunApiKeyCommand(s, []string{"create", "-client", "gateway", "-label", "main", "-scopes", "upload,info"}, &out))
+	keys, _ := s.List("")
+	assert.Len(t, keys, 1)
+	assert.Equal(t, []ApiKeyScope{ScopeUpload, ScopeInfo}, keys[0].Scopes)
+
+	out.Reset()
+	assert.NoError(t, RunApiKeyCommand(s, []string{"list"}, &out))
+	assert.Contains(t, out.String(), keys[0].ID)
+	assert.NotContains(t, out.String(), keys[0].Hash)
+
+	assert.NoError(t, RunApiKeyCommand(s, []string{"revoke", keys[0].ID}, &out))
+	assert.Error(t, RunApiKeyCommand(s, []string{"revoke"}, &out))
+	assert.Error(t, RunApiKeyCommand(s, []string{"unknown"}, &out))
+}
@@ -0,0 +1,258 @@
+package common
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// The request did not contain the credentials required by the Authenticator. Should be answered with 401.
+	ErrNoCredentials = errors.New("no credentials provided")
+	// The request contained credentials, but they were not valid. Should be answered with 403.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Returns the http-status to answer the client with for an error returned from an Authenticator.
+func AuthenticationStatusCode(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrNoCredentials):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrInvalidCredentials):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// Optional for Authenticators. Returns the identity proven by the credentials, which may differ from the ClientId
+// of the AuthenticationPayload, e.g. for a bearer-token or a client-certificate.
+type IdentityAuthenticator interface {
+	AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error)
+}
+
+// Authenticates the request, and returns the identity proven by the credentials.
+// The identity is empty if the Authenticator does not implement IdentityAuthenticator.
+func authenticateIdentity(auth Authenticator, r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	if ia, ok := auth.(IdentityAuthenticator); ok {
+		return ia.AuthenticateIdentity(r, a)
+	}
+	return VerifiedIdentity{}, auth.Authenticate(r, a)
+}
+
+// Middleware that authenticates the AuthenticationPayload stored on the context by ContextMiddleware, and stores
+// the identity proven by the credentials as the VerifiedIdentity, see IdentityAuthenticator. Fields sent by the
+// client, like the Client-Id or the as-user-fields, are never part of the identity. If the Authenticator proves
+// no identity, none is stored, and operations requiring one are denied.
+// An identity already stored, e.g. by JWTAuthenticator.Middleware, is kept.
+func AuthenticationMiddleware(auth Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a, _ := AuthenticationPayloadFromContext(r.Context())
+		id, err := authenticateIdentity(auth, r, a)
+		if err != nil {
+			http.Error(w, err.Error(), AuthenticationStatusCode(err))
+			return
+		}
+		ctx := r.Context()
+		if _, ok := VerifiedIdentityFromContext(ctx); !ok && id != (VerifiedIdentity{}) {
+			ctx = ContextWithVerifiedIdentity(ctx, id)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Adapter to allow the use of ordinary functions as Authenticators
+type AuthenticatorFunc func(r *http.Request, a AuthenticationPayload) error
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	return f(r, a)
+}
+
+type AuthenticatorChainMode int
+
+const (
+	// The first Authenticator to find and accept credentials authenticates the request.
+	// Authenticators that find no credentials are skipped, but invalid credentials stop the chain.
+	FirstMatch AuthenticatorChainMode = iota
+	// Every Authenticator must accept the request.
+	AllMustPass
+)
+
+// Combines multiple Authenticators, like api-keys, bearer-tokens and client-certificates.
+//
+// With FirstMatch, the identity is the one proven by the matching Authenticator. With AllMustPass, the identities
+// are combined, and must not contradict each other.
+type AuthenticatorChain struct {
+	Mode           AuthenticatorChainMode
+	Authenticators []Authenticator
+}
+
+func NewAuthenticatorChain(mode AuthenticatorChainMode, authenticators ...Authenticator) *AuthenticatorChain {
+	return &AuthenticatorChain{
+		Mode:           mode,
+		Authenticators: authenticators,
+	}
+}
+
+func (c *AuthenticatorChain) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := c.AuthenticateIdentity(r, a)
+	return err
+}
+
+func (c *AuthenticatorChain) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	if len(c.Authenticators) == 0 {
+		return VerifiedIdentity{}, ErrNoCredentials
+	}
+	var combined VerifiedIdentity
+	for _, auth := range c.Authenticators {
+		id, err := authenticateIdentity(auth, r, a)
+		switch c.Mode {
+		case AllMustPass:
+			if err != nil {
+				return VerifiedIdentity{}, err
+			}
+			if combined, err = combineIdentities(combined, id); err != nil {
+				return VerifiedIdentity{}, err
+			}
+		default:
+			if err == nil {
+				return id, nil
+			}
+			if !errors.Is(err, ErrNoCredentials) {
+				return VerifiedIdentity{}, err
+			}
+		}
+	}
+	if c.Mode == AllMustPass {
+		return combined, nil
+	}
+	return VerifiedIdentity{}, ErrNoCredentials
+}
+
+// Combines the fields of the identities, which must be equal where both are set.
+func combineIdentities(a, b VerifiedIdentity) (VerifiedIdentity, error) {
+	combine := func(field, x, y string) (string, error) {
+		if x != "" && y != "" && x != y {
+			return "", fmt.Errorf("%w: the credentials prove different %s '%s' and '%s'", ErrInvalidCredentials, field, x, y)
+		}
+		if x == "" {
+			return y, nil
+		}
+		return x, nil
+	}
+	var (
+		id  VerifiedIdentity
+		err error
+	)
+	if id.ClientId, err = combine("client-ids", a.ClientId, b.ClientId); err != nil {
+		return id, err
+	}
+	if id.UserName, err = combine("user-names", a.UserName, b.UserName); err != nil {
+		return id, err
+	}
+	if id.UserId, err = combine("user-ids", a.UserId, b.UserId); err != nil {
+		return id, err
+	}
+	if id.UserSid, err = combine("user-sids", a.UserSid, b.UserSid); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// Authenticates the ClientId and ApiKey of the AuthenticationPayload against a static set of keys.
+type StaticApiKeys map[string]string
+
+func (s StaticApiKeys) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := s.AuthenticateIdentity(r, a)
+	return err
+}
+
+// The identity is the ClientId the api-key belongs to.
+func (s StaticApiKeys) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	if a.ClientId == "" || a.ApiKey == "" {
+		return VerifiedIdentity{}, fmt.Errorf("%w: missing client-id or api-key", ErrNoCredentials)
+	}
+	key, ok := s[a.ClientId]
+	if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(a.ApiKey)) != 1 {
+		return VerifiedIdentity{}, fmt.Errorf("%w: unknown client-id or api-key", ErrInvalidCredentials)
+	}
+	return VerifiedIdentity{ClientId: a.ClientId}, nil
+}
+
+// Returns the token from the Authorization-header, if it uses the Bearer-scheme.
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// Authenticates requests with a bearer-token in the Authorization-header.
+type BearerAuthenticator struct {
+	// Should return an error if the token is not valid. A token verified this way proves no identity.
+	VerifyToken func(token string, a AuthenticationPayload) error
+	// If set, used instead of VerifyToken. Should return the identity the token was issued to,
+	// or an error if the token is not valid.
+	VerifyIdentity func(token string, a AuthenticationPayload) (VerifiedIdentity, error)
+}
+
+func (b BearerAuthenticator) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := b.AuthenticateIdentity(r, a)
+	return err
+}
+
+func (b BearerAuthenticator) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return VerifiedIdentity{}, fmt.Errorf("%w: missing bearer-token", ErrNoCredentials)
+	}
+	var (
+		id  VerifiedIdentity
+		err error
+	)
+	if b.VerifyIdentity != nil {
+		id, err = b.VerifyIdentity(token, a)
+	} else {
+		err = b.VerifyToken(token, a)
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return VerifiedIdentity{}, err
+		}
+		return VerifiedIdentity{}, fmt.Errorf("%w: %s", ErrInvalidCredentials, err)
+	}
+	return id, nil
+}
+
+// Authenticates requests by the identity of a verified TLS client-certificate (mutual TLS).
+// The identity is the Common Name of the certificate's subject.
+type ClientCertAuthenticator struct {
+	// The identities that are allowed. If empty, any verified certificate is accepted.
+	Allowed map[string]bool
+	// Require that the identity is the same as the ClientId of the AuthenticationPayload.
+	MatchClientId bool
+}
+
+func (c ClientCertAuthenticator) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := c.AuthenticateIdentity(r, a)
+	return err
+}
+
+// The identity is the ClientId named by the certificate.
+func (c ClientCertAuthenticator) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return VerifiedIdentity{}, fmt.Errorf("%w: missing verified client-certificate", ErrNoCredentials)
+	}
+	identity := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(c.Allowed) > 0 && !c.Allowed[identity] {
+		return VerifiedIdentity{}, fmt.Errorf("%w: client-certificate '%s' is not allowed", ErrInvalidCredentials, identity)
+	}
+	if c.MatchClientId && identity != a.ClientId {
+		return VerifiedIdentity{}, fmt.Errorf("%w: client-certificate '%s' does not match client-id '%s'", ErrInvalidCredentials, identity, a.ClientId)
+	}
+	return VerifiedIdentity{ClientId: identity}, nil
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticatorChain(t *testing.T) {
+	keys := StaticApiKeys{"watch-folder": "secret"}
+	bearer := BearerAuthenticator{VerifyToken: func(token string, a AuthenticationPayload) error {
+		if token != "valid" {
+			return errors.New("expired")
+		}
+		return nil
+	}}
+	certs := ClientCertAuthenticator{MatchClientId: true}
+
+	withBearer := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	withCert := httptest.NewRequest(http.MethodGet, "/", nil)
+	withCert.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "watch-folder"}}}}}
+
+	tests := []struct {
+		name       string
+		chain      *AuthenticatorChain
+		r          *http.Request
+		a          AuthenticationPayload
+		wantStatus int
+	}{
+		{"api-key", NewAuthenticatorChain(FirstMatch, bearer, keys), httptest.NewRequest(http.MethodGet, "/", nil), AuthenticationPayload{ClientId: "watch-folder", ApiKey: "secret"}, http.StatusOK},
+		{"wrong api-key", NewAuthenticatorChain(FirstMatch, bearer, keys), httptest.NewRequest(http.MethodGet, "/", nil), AuthenticationPayload{ClientId: "watch-folder", ApiKey: "wrong"}, http.StatusForbidden},
+		{"bearer", NewAuthenticatorChain(FirstMatch, bearer, keys), withBearer("valid"), AuthenticationPayload{}, http.StatusOK},
+		{"invalid bearer stops the chain", NewAuthenticatorChain(FirstMatch, bearer, keys), withBearer("old"), AuthenticationPayload{ClientId: "watch-folder", ApiKey: "secret"}, http.StatusForbidden},
+		{"no credentials", NewAuthenticatorChain(FirstMatch, bearer, keys), httptest.NewRequest(http.MethodGet, "/", nil), AuthenticationPayload{}, http.StatusUnauthorized},
+		{"all must pass", NewAuthenticatorChain(AllMustPass, certs, keys), withCert, AuthenticationPayload{ClientId: "watch-folder", ApiKey: "secret"}, http.StatusOK},
+		{"all must pass, missing certificate", NewAuthenticatorChain(AllMustPass, certs, keys), httptest.NewRequest(http.MethodGet, "/", nil), AuthenticationPayload{ClientId: "watch-folder", ApiKey: "secret"}, http.StatusUnauthorized},
+		{"certificate must match client-id", NewAuthenticatorChain(AllMustPass, certs), withCert, AuthenticationPayload{ClientId: "gateway"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.chain.Authenticate(tt.r, tt.a)
+			assert.Equal(t, tt.wantStatus, AuthenticationStatusCode(err), "err: %v", err)
+		})
+	}
+}
+
+func TestAuthenticationMiddleware(t *testing.T) {
+	var (
+		id VerifiedIdentity
+		ok bool
+	)
+	h := ContextMiddleware(DefaultContextHeaders, AuthenticationMiddleware(StaticApiKeys{"watch-folder": "secret"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok = VerifiedIdentityFromContext(r.Context())
+	})))
+	r := httptest.NewRequest(http.MethodPost, "/create", nil)
+	r.Header.Set("Client-Id", "watch-folder")
+	r.Header.Set("Api-Key", "secret")
+	r.Header.Set("As-User-Name", "jane")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.True(t, ok)
+	assert.Equal(t, VerifiedIdentity{ClientId: "watch-folder"}, id, "as-user-fields are not verified")
+
+	ok = false
+	r.Header.Set("Api-Key", "wrong")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.False(t, ok)
+
+	// A bearer-token does not prove the Client-Id sent with it
+	bearer := BearerAuthenticator{VerifyIdentity: func(token string, a AuthenticationPayload) (VerifiedIdentity, error) {
+		return VerifiedIdentity{ClientId: "gateway"}, nil
+	}}
+	h = ContextMiddleware(DefaultContextHeaders, AuthenticationMiddleware(NewAuthenticatorChain(FirstMatch, bearer, StaticApiKeys{"watch-folder": "secret"}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok = VerifiedIdentityFromContext(r.Context())
+	})))
+	r = httptest.NewRequest(http.MethodPost, "/create", nil)
+	r.Header.Set("Client-Id", "watch-folder")
+	r.Header.Set("Authorization", "Bearer token")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.True(t, ok)
+	assert.Equal(t, VerifiedIdentity{ClientId: "gateway"}, id)
+
+	// Authenticators proving no identity store none
+	ok = false
+	h = ContextMiddleware(DefaultContextHeaders, AuthenticationMiddleware(BearerAuthenticator{VerifyToken: func(string, AuthenticationPayload) error { return nil }}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok = VerifiedIdentityFromContext(r.Context())
+	})))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.False(t, ok)
+}
+
+func TestAuthenticatorChain_AllMustPassIdentity(t *testing.T) {
+	withCert := httptest.NewRequest(http.MethodGet, "/", nil)
+	withCert.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "gateway"}}}}}
+	a := AuthenticationPayload{ClientId: "watch-folder", ApiKey: "secret"}
+
+	_, err := NewAuthenticatorChain(AllMustPass, ClientCertAuthenticator{}, StaticApiKeys{"watch-folder": "secret"}).AuthenticateIdentity(withCert, a)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials), "the credentials prove different clients")
+
+	id, err := NewAuthenticatorChain(AllMustPass, ClientCertAuthenticator{}, StaticApiKeys{"gateway": "secret"}).AuthenticateIdentity(withCert, AuthenticationPayload{ClientId: "gateway", ApiKey: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, VerifiedIdentity{ClientId: "gateway"}, id)
+}
@@ -0,0 +1,282 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+var (
+	ErrForbidden = errors.New("operation not permitted")
+)
+
+type Operation string
+
+const (
+	OperationCreate   Operation = "create"
+	OperationValidate Operation = "validate"
+	OperationSearch   Operation = "search"
+	OperationInfo     Operation = "info"
+	OperationUpdate   Operation = "update"
+)
+
+// Applies to all connectors, when used as connector-id in Role.Permissions
+const AnyConnector = "*"
+
+type Role struct {
+	Name string
+	// The operations permitted, by connector-id. Use AnyConnector to permit operations on all connectors.
+	Permissions map[string][]Operation
+	// If set, uploads are only permitted into these parents, matched by Parent.Id, or by Parent.Name if the upload
+	// has no Parent.Id.
+	Parents []string
+	// If set, uploads are only permitted with these case-numbers.
+	CaseNumbers []string
+}
+
+func (r Role) permits(connectorId string, op Operation) bool {
+	for _, id := range []string{connectorId, AnyConnector} {
+		for _, o := range r.Permissions[id] {
+			if o == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r Role) permitsUpload(um metadata.UploadMetadata) bool {
+	if len(r.Parents) > 0 {
+		parent := um.Parent.Id
+		if parent == "" {
+			parent = um.Parent.Name
+		}
+		if !contains(r.Parents, parent) {
+			return false
+		}
+	}
+	if len(r.CaseNumbers) > 0 && !contains(r.CaseNumbers, um.CaseNumber) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Assigns roles to verified identities. Every non-empty field must match the VerifiedIdentity,
+// so a binding with only ClientId applies to all users of that client.
+//
+// As-user-fields sent by a client are never matched, as they are not part of the VerifiedIdentity.
+type RoleBinding struct {
+	ClientId string
+	UserName string
+	UserId   string
+	UserSid  string
+	Roles    []string
+}
+
+func (b RoleBinding) matches(id VerifiedIdentity) bool {
+	if b.ClientId == "" && b.UserName == "" && b.UserId == "" && b.UserSid == "" {
+		return false
+	}
+	return (b.ClientId == "" || b.ClientId == id.ClientId) &&
+		(b.UserName == "" || b.UserName == id.UserName) &&
+		(b.UserId == "" || b.UserId == id.UserId) &&
+		(b.UserSid == "" || b.UserSid == id.UserSid)
+}
+
+// Decides which operations a verified identity may perform on each connector.
+type Authorizer struct {
+	Roles    map[string]Role
+	Bindings []RoleBinding
+}
+
+func NewAuthorizer(roles []Role, bindings []RoleBinding) *Authorizer {
+	z := &Authorizer{
+		Roles:    map[string]Role{},
+		Bindings: bindings,
+	}
+	for _, r := range roles {
+		z.Roles[r.Name] = r
+	}
+	return z
+}
+
+// Returns the roles bound to the identity.
+func (z *Authorizer) RolesFor(id VerifiedIdentity) []Role {
+	var roles []Role
+	seen := map[string]bool{}
+	for _, b := range z.Bindings {
+		if !b.matches(id) {
+			continue
+		}
+		for _, name := range b.Roles {
+			r, ok := z.Roles[name]
+			if !ok || seen[name] {
+				continue
+			}
+			seen[name] = true
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// Returns an error wrapping ErrForbidden if none of the identity's roles permit the operation on the connector.
+func (z *Authorizer) Authorize(id VerifiedIdentity, connectorId string, op Operation) error {
+	for _, r := range z.RolesFor(id) {
+		if r.permits(connectorId, op) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: '%s' on connector '%s'", ErrForbidden, op, connectorId)
+}
+
+// Like Authorize with OperationCreate, but also checks the Parent and CaseNumber of the upload.
+func (z *Authorizer) AuthorizeUpload(id VerifiedIdentity, connectorId string, um metadata.UploadMetadata) error {
+	return z.authorizeMetadata(id, connectorId, OperationCreate, um)
+}
+
+// Like Authorize with OperationUpdate, but also checks the Parent and CaseNumber of the updated metadata.
+func (z *Authorizer) AuthorizeUpdate(id VerifiedIdentity, connectorId string, um metadata.UploadMetadata) error {
+	return z.authorizeMetadata(id, connectorId, OperationUpdate, um)
+}
+
+func (z *Authorizer) authorizeMetadata(id VerifiedIdentity, connectorId string, op Operation, um metadata.UploadMetadata) error {
+	permitted := false
+	for _, r := range z.RolesFor(id) {
+		if !r.permits(connectorId, op) {
+			continue
+		}
+		permitted = true
+		if r.permitsUpload(um) {
+			return nil
+		}
+	}
+	if !permitted {
+		return fmt.Errorf("%w: '%s' on connector '%s'", ErrForbidden, op, connectorId)
+	}
+	return fmt.Errorf("%w: '%s' with parent '%s' and case-number '%s' on connector '%s'", ErrForbidden, op, um.Parent.Name, um.CaseNumber, connectorId)
+}
+
+// Returns the VerifiedIdentity from the context, or an error wrapping ErrForbidden if there is none.
+func verifiedIdentityFor(ctx context.Context) (VerifiedIdentity, error) {
+	if id, ok := VerifiedIdentityFromContext(ctx); ok {
+		return id, nil
+	}
+	return VerifiedIdentity{}, fmt.Errorf("%w: the request has no verified identity", ErrForbidden)
+}
+
+// NewUploadInitiator that is only called for permitted uploads.
+// Requires the VerifiedIdentity on the context, see AuthenticationMiddleware.
+type AuthorizedUploadInitiator struct {
+	NewUploadInitiator
+	Authorizer  *Authorizer
+	ConnectorId string
+}
+
+func (u AuthorizedUploadInitiator) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	id, err := verifiedIdentityFor(ctx)
+	if err != nil {
+		return err
+	}
+	if err := u.Authorizer.AuthorizeUpload(id, u.ConnectorId, data.GetUploadMetadata()); err != nil {
+		return err
+	}
+	return u.NewUploadInitiator.InitiateNewUpload(ctx, data)
+}
+
+// Validator that is only called for permitted identities.
+// Requires the VerifiedIdentity on the request-context, see AuthenticationMiddleware.
+type AuthorizedValidator struct {
+	Validator
+	Authorizer  *Authorizer
+	ConnectorId string
+}
+
+func (v AuthorizedValidator) Validate(r *http.Request, a AuthenticationPayload, p ValidatePayload) (ValidateResponse, error) {
+	id, err := verifiedIdentityFor(r.Context())
+	if err != nil {
+		return ValidateResponse{}, err
+	}
+	if err := v.Authorizer.Authorize(id, v.ConnectorId, OperationValidate); err != nil {
+		return ValidateResponse{}, err
+	}
+	return v.Validator.Validate(r, a, p)
+}
+
+// SearchHandler that is only called for permitted identities.
+// Requires the VerifiedIdentity on the context passed to SearchContext, so Search, which has no context, is denied.
+type AuthorizedSearchHandler struct {
+	SearchHandler
+	Authorizer  *Authorizer
+	ConnectorId string
+}
+
+func (s AuthorizedSearchHandler) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	return s.SearchContext(context.Background(), a, in)
+}
+
+func (s AuthorizedSearchHandler) SearchContext(ctx context.Context, a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	id, err := verifiedIdentityFor(ctx)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	if err := s.Authorizer.Authorize(id, s.ConnectorId, OperationSearch); err != nil {
+		return SearchResult{}, err
+	}
+	return searchContext(ctx, s.SearchHandler, a, in)
+}
+
+// MetadataWriter that is only called for identities permitted to get info about uploads.
+// Requires the VerifiedIdentity on the context, see AuthenticationMiddleware.
+type AuthorizedMetadataWriter struct {
+	MetadataWriter
+	Authorizer  *Authorizer
+	ConnectorId string
+}
+
+func (m AuthorizedMetadataWriter) OutputMetadata(ctx context.Context, info tusd.FileInfo) ([]byte, string, error) {
+	id, err := verifiedIdentityFor(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := m.Authorizer.Authorize(id, m.ConnectorId, OperationInfo); err != nil {
+		return nil, "", err
+	}
+	return m.MetadataWriter.OutputMetadata(ctx, info)
+}
+
+// UploadMetadataUpdater that is only called for permitted updates. The Parent and CaseNumber of the updated
+// metadata are checked as for new uploads. Requires the VerifiedIdentity on the context, see AuthenticationMiddleware.
+// Deferred updates are authorized before they are queued, so HandleMetadataUpdateQueue should get the connector itself.
+type AuthorizedMetadataUpdater struct {
+	UploadMetadataUpdater
+	Authorizer  *Authorizer
+	ConnectorId string
+}
+
+func (u AuthorizedMetadataUpdater) UpdateMetadata(ctx context.Context, info tusd.FileInfo, update MetadataUpdate) (UploadResult, error) {
+	id, err := verifiedIdentityFor(ctx)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if err := u.Authorizer.AuthorizeUpdate(id, u.ConnectorId, update.Current); err != nil {
+		return UploadResult{}, err
+	}
+	return u.UploadMetadataUpdater.UpdateMetadata(ctx, info, update)
+}
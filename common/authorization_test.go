@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+type initiator struct{ called bool }
+
+func (i *initiator) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	i.called = true
+	return nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	z := NewAuthorizer([]Role{
+		{Name: "reader", Permissions: map[string][]Operation{AnyConnector: {OperationSearch, OperationInfo}}},
+		{Name: "investigator", Permissions: map[string][]Operation{"s3": {OperationCreate, OperationValidate}}, CaseNumbers: []string{"C6288"}},
+	}, []RoleBinding{
+		{ClientId: "app", Roles: []string{"reader"}},
+		{ClientId: "app", UserName: "jane", Roles: []string{"investigator"}},
+	})
+	jane := VerifiedIdentity{ClientId: "app", UserName: "jane"}
+	john := VerifiedIdentity{ClientId: "app", UserName: "john"}
+
+	assert.NoError(t, z.Authorize(john, "s3", OperationSearch))
+	assert.True(t, errors.Is(z.Authorize(john, "s3", OperationCreate), ErrForbidden))
+	assert.NoError(t, z.Authorize(jane, "s3", OperationValidate))
+	assert.Error(t, z.Authorize(jane, "webdav", OperationValidate))
+	assert.Error(t, z.Authorize(VerifiedIdentity{ClientId: "other"}, "s3", OperationSearch))
+
+	assert.NoError(t, z.AuthorizeUpload(jane, "s3", metadata.UploadMetadata{CaseNumber: "C6288"}))
+	assert.Error(t, z.AuthorizeUpload(jane, "s3", metadata.UploadMetadata{CaseNumber: "C1"}))
+
+	i := &initiator{}
+	u := AuthorizedUploadInitiator{i, z, "s3"}
+	data := metadata.UploadMetadata{CaseNumber: "C6288"}.ConvertToMetaData()
+	data.SetClientId("app").SetAsUserName("jane")
+	assert.True(t, errors.Is(u.InitiateNewUpload(context.Background(), &data), ErrForbidden), "the metadata is not a verified identity")
+	// As-user-fields sent by the client do not bind roles
+	ctx := ContextWithAuthenticationPayload(context.Background(), AuthenticationPayload{ClientId: "app", UserName: "jane"})
+	ctx = ContextWithVerifiedIdentity(ctx, VerifiedIdentity{ClientId: "app"})
+	assert.True(t, errors.Is(u.InitiateNewUpload(ctx, &data), ErrForbidden))
+	assert.False(t, i.called)
+	assert.NoError(t, u.InitiateNewUpload(ContextWithVerifiedIdentity(context.Background(), jane), &data))
+	assert.True(t, i.called)
+
+	v := AuthorizedValidator{Authorizer: z, ConnectorId: "s3"}
+	r := httptest.NewRequest(http.MethodPost, "/validate", nil)
+	_, err := v.Validate(r, AuthenticationPayload{ClientId: "app", UserName: "jane"}, ValidatePayload{})
+	assert.True(t, errors.Is(err, ErrForbidden), "the as-user-name of the payload is not verified")
+
+	mu := AuthorizedMetadataUpdater{&updatingConnector{}, z, "s3"}
+	_, err = mu.UpdateMetadata(ContextWithVerifiedIdentity(context.Background(), jane), tusd.FileInfo{}, MetadataUpdate{})
+	assert.True(t, errors.Is(err, ErrForbidden), "investigators may not update")
+
+	s := AuthorizedSearchHandler{staticSearcher{}, z, "s3"}
+	_, err = s.Search(AuthenticationPayload{ClientId: "app"}, SearchInput{})
+	assert.True(t, errors.Is(err, ErrForbidden), "the client-id of the payload is not verified")
+	_, err = s.SearchContext(ContextWithVerifiedIdentity(context.Background(), john), AuthenticationPayload{ClientId: "app"}, SearchInput{})
+	assert.NoError(t, err)
+}
+
+func TestRole_Parents(t *testing.T) {
+	r := Role{Parents: []string{"p-1", "Evidence"}}
+	assert.True(t, r.permitsUpload(metadata.UploadMetadata{Parent: metadata.Parent{Id: "p-1", Name: "Other"}}))
+	assert.False(t, r.permitsUpload(metadata.UploadMetadata{Parent: metadata.Parent{Id: "p-2", Name: "Evidence"}}), "the name is only matched without an id")
+	assert.True(t, r.permitsUpload(metadata.UploadMetadata{Parent: metadata.Parent{Name: "Evidence"}}))
+}
+
+type metadataWriter struct{}
+
+func (metadataWriter) OutputMetadata(ctx context.Context, info tusd.FileInfo) ([]byte, string, error) {
+	return []byte("{}"), "application/json", nil
+}
+
+func TestAuthorizedMetadataWriter(t *testing.T) {
+	z := NewAuthorizer([]Role{
+		{Name: "reader", Permissions: map[string][]Operation{AnyConnector: {OperationInfo}}},
+	}, []RoleBinding{
+		{ClientId: "app", UserName: "jane", Roles: []string{"reader"}},
+	})
+	m := AuthorizedMetadataWriter{metadataWriter{}, z, "s3"}
+	_, _, err := m.OutputMetadata(context.Background(), tusd.FileInfo{})
+	assert.True(t, errors.Is(err, ErrForbidden))
+	_, _, err = m.OutputMetadata(ContextWithVerifiedIdentity(context.Background(), VerifiedIdentity{ClientId: "app", UserName: "john"}), tusd.FileInfo{})
+	assert.True(t, errors.Is(err, ErrForbidden))
+	b, _, err := m.OutputMetadata(ContextWithVerifiedIdentity(context.Background(), VerifiedIdentity{ClientId: "app", UserName: "jane"}), tusd.FileInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(b))
+}
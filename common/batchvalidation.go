@@ -0,0 +1,132 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var (
+	ErrBatchTooLarge = errors.New("too many payloads in batch")
+)
+
+// BatchValidator for connectors that only implement Validator.
+//
+// Each payload is validated whole, as connectors may validate fields against each other, e.g. a case against
+// the user. Identical payloads are only validated once. Connectors validating each field on its own can opt in to
+// splitting, so that identical lookups, like the same CaseID across different users, are only made once:
+// if SplitEntities is set, payloads are split by the entity of their fields, so that the fields identifying a user
+// are validated together, and if SplitFields is set, each field is validated on its own.
+type BatchValidatorAdapter struct {
+	Validator
+	SplitEntities bool
+	SplitFields   bool
+	// The number of lookups to make at the same time. Defaults to 1.
+	Concurrency int
+}
+
+// Returns a payload for each field that is set, or for each entity with fields set if byEntity is set.
+func splitValidatePayload(p ValidatePayload, byEntity bool) []ValidatePayload {
+	var (
+		parts    []ValidatePayload
+		entities = map[FieldEntity]int{}
+	)
+	for _, kind := range p.Fields() {
+		d, _ := Field(kind)
+		i, ok := entities[d.Entity]
+		if !ok || !byEntity {
+			i = len(parts)
+			entities[d.Entity] = i
+			parts = append(parts, ValidatePayload{})
+		}
+		parts[i].Set(kind, p.Get(kind))
+	}
+	return parts
+}
+
+func (b BatchValidatorAdapter) ValidateBatch(r *http.Request, a AuthenticationPayload, payloads []ValidatePayload) ([]ValidateNullableResponse, error) {
+	var (
+		lookups []ValidatePayload
+		seen    = map[ValidatePayload]int{}
+		// The lookups of each payload
+		items = make([][]int, len(payloads))
+	)
+	for i, p := range payloads {
+		parts := []ValidatePayload{p}
+		if b.SplitFields || b.SplitEntities {
+			parts = splitValidatePayload(p, !b.SplitFields)
+		}
+		for _, part := range parts {
+			j, ok := seen[part]
+			if !ok {
+				j = len(lookups)
+				seen[part] = j
+				lookups = append(lookups, part)
+			}
+			items[i] = append(items[i], j)
+		}
+	}
+
+	loc := LocalizerFromRequest(r)
+	results := make([]ValidateResponse, len(lookups))
+	errs := make([]error, len(lookups))
+	concurrency := b.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for j := range lookups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(j int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[j], errs[j] = b.Validator.Validate(r, a, lookups[j])
+		}(j)
+	}
+	wg.Wait()
+
+	out := make([]ValidateNullableResponse, len(payloads))
+	for i := range payloads {
+		for _, j := range items[i] {
+			if errs[j] != nil {
+				e := batchValidationError(loc, errs[j])
+				out[i].Error = &e
+				continue
+			}
+			results[j].copyNullable(lookups[j], &out[i])
+		}
+	}
+	return out, nil
+}
+
+// Errors from Validate are returned for the item, so that the rest of the batch still succeeds.
+func batchValidationError(loc Localizer, err error) ValidationErrorResponse {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return limitErr.Localized(loc).ValidationErrorResponse
+	}
+	return loc.ValidationError("ValidationFailed", http.StatusBadGateway, "ValidationFailed.Title", "ValidationFailed.Subtitle", nil,
+		Localizable{RawKey: "reason", RawValue: err.Error()}.Localized(loc, "Error.Reason", "", nil))
+}
+
+// Validates the payloads with the validator, using its BatchValidator-implementation if it has one.
+// If max is above zero, batches larger than that are rejected with ErrBatchTooLarge.
+func ValidateBatch(v Validator, r *http.Request, a AuthenticationPayload, payloads []ValidatePayload, max int) ([]ValidateNullableResponse, error) {
+	if max > 0 && len(payloads) > max {
+		return nil, fmt.Errorf("%w: %d payloads, max %d", ErrBatchTooLarge, len(payloads), max)
+	}
+	if b, ok := v.(BatchValidator); ok {
+		res, err := b.ValidateBatch(r, a, payloads)
+		if err != nil {
+			return res, err
+		}
+		if len(res) != len(payloads) {
+			return res, fmt.Errorf("the batch-validator returned %d responses for %d payloads", len(res), len(payloads))
+		}
+		return res, nil
+	}
+	return BatchValidatorAdapter{Validator: v}.ValidateBatch(r, a, payloads)
+}
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingValidator struct {
+	mu    sync.Mutex
+	calls []ValidatePayload
+}
+
+func (v *countingValidator) Validate(r *http.Request, a AuthenticationPayload, p ValidatePayload) (ValidateResponse, error) {
+	v.mu.Lock()
+	v.calls = append(v.calls, p)
+	v.mu.Unlock()
+	if p.CaseID == "broken" {
+		return ValidateResponse{}, errors.New("backend unavailable")
+	}
+	res := ValidateResponse{
+		CaseID:   ValidateCaseResponse{ID: p.CaseID, Name: "Case " + p.CaseID},
+		UserName: ValidateUserResponse{ID: "id-" + p.UserName, UserName: p.UserName},
+	}
+	switch p.CaseID {
+	case "unknown":
+		res.CaseID = ValidateCaseResponse{Error: &ValidationErrorResponse{Status: "NotFound", StatusCode: http.StatusNotFound}}
+	case "unavailable":
+		res.CaseID = ValidateCaseResponse{Error: &ValidationErrorResponse{Status: "Unavailable", StatusCode: http.StatusServiceUnavailable}}
+	case "unspecified":
+		res.CaseID = ValidateCaseResponse{Error: &ValidationErrorResponse{Status: "Unspecified"}}
+	}
+	return res, nil
+}
+
+func TestBatchValidatorAdapter(t *testing.T) {
+	payloads := []ValidatePayload{
+		{CaseID: "C1", UserName: "jane"},
+		{CaseID: "C1", UserName: "john"},
+		{CaseID: "C1", UserName: "jane"},
+		{CaseID: "unknown"},
+		{CaseID: "broken", UserName: "jane"},
+	}
+
+	t.Run("identical payloads", func(t *testing.T) {
+		v := &countingValidator{}
+		res, err := BatchValidatorAdapter{Validator: v, Concurrency: 3}.ValidateBatch(nil, AuthenticationPayload{}, payloads)
+		assert.NoError(t, err)
+		assert.Len(t, v.calls, 4)
+		assert.Len(t, res, len(payloads))
+		assert.Equal(t, "jane", res[0].UserName.UserName)
+		assert.Equal(t, "john", res[1].UserName.UserName)
+		assert.Equal(t, res[0], res[2])
+		assert.Equal(t, http.StatusNotFound, res[3].CaseID.Error.StatusCode)
+		assert.Nil(t, res[3].UserName)
+		assert.Equal(t, http.StatusBadGateway, res[4].Error.StatusCode)
+		assert.Equal(t, "The value could not be validated", res[4].Error.Subtitle)
+		assert.Equal(t, "backend unavailable", res[4].Error.Details[0].RawValue)
+	})
+
+	t.Run("localized errors", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/validate", nil)
+		r.Header.Set("Accept-Language", "nb-NO")
+		res, err := BatchValidatorAdapter{Validator: &countingValidator{}}.ValidateBatch(r, AuthenticationPayload{}, payloads)
+		assert.NoError(t, err)
+		assert.Equal(t, "Validering feilet", res[4].Error.Title)
+		assert.Equal(t, "Årsak", res[4].Error.Details[0].Key)
+	})
+
+	t.Run("split fields", func(t *testing.T) {
+		v := &countingValidator{}
+		res, err := BatchValidatorAdapter{Validator: v, SplitFields: true}.ValidateBatch(nil, AuthenticationPayload{}, payloads)
+		assert.NoError(t, err)
+		// C1, jane, john, unknown, broken
+		assert.Len(t, v.calls, 5)
+		assert.Equal(t, "Case C1", res[1].CaseID.Name)
+		assert.Equal(t, "john", res[1].UserName.UserName)
+		// The failing field does not hide the one that succeeded
+		assert.NotNil(t, res[4].Error)
+		assert.Equal(t, "jane", res[4].UserName.UserName)
+		assert.Nil(t, res[4].CaseID)
+	})
+}
+
+func TestBatchValidatorAdapter_Entities(t *testing.T) {
+	payloads := []ValidatePayload{
+		{CaseID: "C1", UserName: "jane", UserID: "1"},
+		{CaseID: "C1", UserName: "john", UserID: "2"},
+		{CaseID: "C1", UserName: "jane", UserID: "1"},
+	}
+	v := &countingValidator{}
+	res, err := BatchValidatorAdapter{Validator: v, SplitEntities: true}.ValidateBatch(nil, AuthenticationPayload{}, payloads)
+	assert.NoError(t, err)
+	// The same case across different users is validated once, while the fields of each user are validated together
+	assert.ElementsMatch(t, []ValidatePayload{{CaseID: "C1"}, {UserName: "jane", UserID: "1"}, {UserName: "john", UserID: "2"}}, v.calls)
+	assert.Equal(t, "Case C1", res[1].CaseID.Name)
+	assert.Equal(t, "john", res[1].UserName.UserName)
+	assert.Equal(t, res[0], res[2])
+}
+
+type nativeBatchValidator struct {
+	countingValidator
+	n int
+}
+
+func (v *nativeBatchValidator) ValidateBatch(r *http.Request, a AuthenticationPayload, payloads []ValidatePayload) ([]ValidateNullableResponse, error) {
+	return make([]ValidateNullableResponse, v.n), nil
+}
+
+func TestValidateBatch(t *testing.T) {
+	payloads := []ValidatePayload{{CaseID: "C1"}, {CaseID: "C2"}}
+
+	v := &countingValidator{}
+	res, err := ValidateBatch(v, nil, AuthenticationPayload{}, payloads, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "C2", res[1].CaseID.ID)
+
+	_, err = ValidateBatch(v, nil, AuthenticationPayload{}, payloads, 1)
+	assert.True(t, errors.Is(err, ErrBatchTooLarge))
+
+	native := &nativeBatchValidator{n: 2}
+	res, err = ValidateBatch(native, nil, AuthenticationPayload{}, payloads, 0)
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+	assert.Empty(t, native.calls)
+
+	native.n = 1
+	_, err = ValidateBatch(native, nil, AuthenticationPayload{}, payloads, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,338 @@
+package common
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/indicosystems/proxy-common/metadata"
+)
+
+//go:embed locales/*.json
+var defaultLocales embed.FS
+
+// A localized message. In catalog-files, it is either a string, or an object with plural-forms:
+//
+//	"TooManyRequests.Subtitle": {"one": "Please try again in {count} second", "other": "Please try again in {count} seconds"}
+//
+// Parameters are interpolated as {name}.
+type Message struct {
+	Zero  string `json:"zero,omitempty"`
+	One   string `json:"one,omitempty"`
+	Other string `json:"other,omitempty"`
+}
+
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*m = Message{Other: s}
+		return nil
+	}
+	type plain Message
+	return json.Unmarshal(b, (*plain)(m))
+}
+
+// Returns the form for the count. Zero falls back to Other, and One falls back to Other.
+func (m Message) form(count int) string {
+	switch {
+	case count == 0 && m.Zero != "":
+		return m.Zero
+	case count == 1 && m.One != "":
+		return m.One
+	}
+	return m.Other
+}
+
+// Keyed messages per locale.
+//
+// Lookups fall back through the locale-chain, e.g. nb-NO → nb → the default locale,
+// and finally to the key itself.
+type Catalog struct {
+	DefaultLocale string
+	mu            sync.RWMutex
+	messages      map[string]map[string]Message
+}
+
+func NewCatalog(defaultLocale string) *Catalog {
+	return &Catalog{
+		DefaultLocale: normalizeLocale(defaultLocale),
+		messages:      map[string]map[string]Message{},
+	}
+}
+
+var (
+	defaultCatalog     *Catalog
+	defaultCatalogOnce sync.Once
+)
+
+// Returns a catalog with the messages of this package, in English and Norwegian Bokmål.
+// Connectors can add their own messages to it, or load them into a catalog of their own.
+func DefaultCatalog() *Catalog {
+	defaultCatalogOnce.Do(func() {
+		defaultCatalog = NewCatalog("en")
+		if err := defaultCatalog.LoadFS(defaultLocales, "locales"); err != nil {
+			panic(fmt.Sprintf("failed to load the default catalog: %s", err))
+		}
+	})
+	return defaultCatalog
+}
+
+// Returns a Localizer for the default locale of DefaultCatalog, for messages built without a request.
+func defaultLocalizer() Localizer {
+	return DefaultCatalog().Localizer(DefaultCatalog().DefaultLocale)
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// Adds messages to the locale, replacing existing messages with the same keys.
+func (c *Catalog) Add(locale string, messages map[string]Message) {
+	locale = normalizeLocale(locale)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.messages[locale] == nil {
+		c.messages[locale] = map[string]Message{}
+	}
+	for key, m := range messages {
+		c.messages[locale][key] = m
+	}
+}
+
+// Loads messages for the locale from JSON.
+func (c *Catalog) LoadJSON(locale string, b []byte) error {
+	var messages map[string]Message
+	if err := json.Unmarshal(b, &messages); err != nil {
+		return fmt.Errorf("failed to parse catalog for '%s': %w", locale, err)
+	}
+	c.Add(locale, messages)
+	return nil
+}
+
+// Loads every <locale>.json-file in the directory, e.g. from an embed.FS.
+func (c *Catalog) LoadFS(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		b, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return fmt.Errorf("failed to read catalog '%s': %w", f, err)
+		}
+		if err := c.LoadJSON(strings.TrimSuffix(path.Base(f), ".json"), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the locale and its parents, e.g. nb-no and nb.
+func parentLocales(locale string) []string {
+	var chain []string
+	for l := normalizeLocale(locale); l != ""; {
+		chain = append(chain, l)
+		i := strings.LastIndex(l, "-")
+		if i < 0 {
+			break
+		}
+		l = l[:i]
+	}
+	return chain
+}
+
+// Returns the locales to look up, in order. nb-NO gives nb-no, nb and then the default locale.
+func (c *Catalog) LocaleChain(locale string) []string {
+	chain := parentLocales(locale)
+	if c.DefaultLocale != "" && !contains(chain, c.DefaultLocale) {
+		chain = append(chain, c.DefaultLocale)
+	}
+	return chain
+}
+
+func (c *Catalog) hasLocale(locale string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.messages[locale]) > 0
+}
+
+// Returns the best locale for an Accept-Language-header, falling back to the default locale.
+func (c *Catalog) Match(acceptLanguage string) string {
+	for _, l := range ParseAcceptLanguage(acceptLanguage) {
+		if l == "*" {
+			break
+		}
+		for _, candidate := range parentLocales(l) {
+			if c.hasLocale(candidate) {
+				// Keep the region, so that regional messages added later are used
+				return normalizeLocale(l)
+			}
+		}
+	}
+	return c.DefaultLocale
+}
+
+// Returns the language-ranges of an Accept-Language-header, ordered by quality.
+func ParseAcceptLanguage(header string) []string {
+	type ranged struct {
+		locale string
+		q      float64
+	}
+	var ranges []ranged
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		locale := normalizeLocale(fields[0])
+		if locale == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				if parsed, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, ranged{locale, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	locales := make([]string, len(ranges))
+	for i, r := range ranges {
+		locales[i] = r.locale
+	}
+	return locales
+}
+
+func (c *Catalog) lookup(locale, key string) (Message, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, l := range c.LocaleChain(locale) {
+		if m, ok := c.messages[l][key]; ok {
+			return m, true
+		}
+	}
+	return Message{}, false
+}
+
+// Returns a Localizer for the locale.
+func (c *Catalog) Localizer(locale string) Localizer {
+	return Localizer{Catalog: c, Locale: normalizeLocale(locale)}
+}
+
+// Returns a Localizer for the Accept-Language of the request.
+func (c *Catalog) LocalizerForRequest(r *http.Request) Localizer {
+	return c.Localizer(c.Match(r.Header.Get("Accept-Language")))
+}
+
+func ContextWithLocalizer(ctx context.Context, l Localizer) context.Context {
+	return context.WithValue(ctx, localizerKey, l)
+}
+
+// Returns the Localizer stored on the context, or one for the default locale of DefaultCatalog.
+func LocalizerFromContext(ctx context.Context) Localizer {
+	if l, ok := ctx.Value(localizerKey).(Localizer); ok {
+		return l
+	}
+	return defaultLocalizer()
+}
+
+// Returns the Localizer stored on the request-context, or one from DefaultCatalog for the Accept-Language.
+// A nil request gives the default locale.
+func LocalizerFromRequest(r *http.Request) Localizer {
+	if r == nil {
+		return defaultLocalizer()
+	}
+	if l, ok := r.Context().Value(localizerKey).(Localizer); ok {
+		return l
+	}
+	return DefaultCatalog().LocalizerForRequest(r)
+}
+
+// Middleware that stores a Localizer for the Accept-Language on the request-context, for connectors with a
+// catalog of their own.
+func LocalizerMiddleware(c *Catalog, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(ContextWithLocalizer(r.Context(), c.LocalizerForRequest(r))))
+	})
+}
+
+// Params are interpolated into messages as {name}.
+type Params map[string]interface{}
+
+// Localizes messages from a Catalog for a single locale.
+type Localizer struct {
+	Catalog *Catalog
+	Locale  string
+}
+
+// Returns the message for the key, with the params interpolated. Returns the key if the message is not found.
+func (l Localizer) T(key string, params Params) string {
+	m, ok := l.Catalog.lookup(l.Locale, key)
+	if !ok {
+		return key
+	}
+	return interpolate(m.form(-1), params)
+}
+
+// Returns the plural-form of the message for the count, with the params and {count} interpolated.
+func (l Localizer) Plural(key string, count int, params Params) string {
+	m, ok := l.Catalog.lookup(l.Locale, key)
+	if !ok {
+		return key
+	}
+	p := Params{"count": count}
+	for k, v := range params {
+		p[k] = v
+	}
+	return interpolate(m.form(count), p)
+}
+
+func interpolate(s string, params Params) string {
+	if len(params) == 0 || !strings.Contains(s, "{") {
+		return s
+	}
+	pairs := make([]string, 0, len(params)*2)
+	for k, v := range params {
+		pairs = append(pairs, "{"+k+"}", fmt.Sprint(v))
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// Returns a Localizable with the key and value localized from the message-keys.
+// If valueKey is empty, the raw value is used as is.
+func (l Localizable) Localized(loc Localizer, key, valueKey string, params Params) Localizable {
+	l.Key = loc.T(key, params)
+	l.Value = l.RawValue
+	if valueKey != "" {
+		l.Value = loc.T(valueKey, params)
+	}
+	return l
+}
+
+// Builds a validation-error with the title and subtitle localized from the message-keys.
+// The subtitle is skipped if its key is empty.
+func (l Localizer) ValidationError(status string, statusCode int, titleKey, subtitleKey string, params Params, details ...Localizable) ValidationErrorResponse {
+	r := LocalizedResponse{
+		Title:   l.T(titleKey, params),
+		Details: details,
+	}
+	if subtitleKey != "" {
+		r.Subtitle = l.T(subtitleKey, params)
+	}
+	return NewValidationError(status, statusCode, r)
+}
+
+// Builds a ClientMessage with the message localized from the message-key.
+func (l Localizer) ClientMessage(kind metadata.InternalInfoStr, key string, params Params) metadata.ClientMessage {
+	return metadata.ClientMessage{Kind: kind, Message: l.T(key, params)}
+}
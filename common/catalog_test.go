@@ -0,0 +1,73 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	assert.Equal(t, []string{"nb-no", "nb", "en"}, ParseAcceptLanguage("en;q=0.5, nb-NO, nb;q=0.8, sv;q=0"))
+	assert.Empty(t, ParseAcceptLanguage(""))
+}
+
+func TestCatalog(t *testing.T) {
+	c := NewCatalog("en")
+	assert.NoError(t, c.LoadJSON("en", []byte(`{"Hello": "Hello, {name}", "Only.En": "English", "Files": {"one": "{count} file", "other": "{count} files"}}`)))
+	assert.NoError(t, c.LoadJSON("nb", []byte(`{"Hello": "Hei, {name}", "Files": {"zero": "Ingen filer", "one": "{count} fil", "other": "{count} filer"}}`)))
+	c.Add("nb-NO", map[string]Message{"Hello": {Other: "Hallo, {name}"}})
+	assert.Error(t, c.LoadJSON("sv", []byte(`{"Hello": 1}`)))
+
+	assert.Equal(t, []string{"nb-no", "nb", "en"}, c.LocaleChain("nb_NO"))
+	assert.Equal(t, []string{"en"}, c.LocaleChain("en"))
+
+	tests := []struct {
+		acceptLanguage, want string
+	}{
+		{"nb-NO", "nb-no"},
+		{"nb-NO-x-oslo", "nb-no-x-oslo"},
+		{"sv, nb;q=0.9", "nb"},
+		{"sv", "en"},
+		{"", "en"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, c.Match(tt.acceptLanguage), tt.acceptLanguage)
+	}
+
+	nbNO := c.Localizer("nb-NO")
+	assert.Equal(t, "Hallo, Jane", nbNO.T("Hello", Params{"name": "Jane"}))
+	assert.Equal(t, "English", nbNO.T("Only.En", nil))
+	assert.Equal(t, "Missing.Key", nbNO.T("Missing.Key", nil))
+	assert.Equal(t, "Ingen filer", nbNO.Plural("Files", 0, nil))
+	assert.Equal(t, "1 fil", nbNO.Plural("Files", 1, nil))
+	assert.Equal(t, "3 filer", nbNO.Plural("Files", 3, nil))
+	assert.Equal(t, "0 files", c.Localizer("en").Plural("Files", 0, nil))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "nb")
+	assert.Equal(t, "Hei, Jane", c.LocalizerForRequest(r).T("Hello", Params{"name": "Jane"}))
+}
+
+func TestDefaultCatalogHelpers(t *testing.T) {
+	nb := DefaultCatalog().Localizer("nb-NO")
+	res := nb.ValidationError("TooManyRequests", http.StatusTooManyRequests, "TooManyRequests.Title", "", nil,
+		Localizable{RawKey: "retryAfter", RawValue: "3"}.Localized(nb, "TooManyRequests.Title", "", nil))
+	assert.Equal(t, "For mange forespørsler", res.Title)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "3", res.Details[0].Value)
+	assert.Equal(t, "Prøv igjen om 3 sekunder", nb.Plural("TooManyRequests.Subtitle", 3, nil))
+
+	msg := DefaultCatalog().Localizer("en").ClientMessage(metadata.MimeMismatch, "MimeMismatch", Params{"declared": "video/mp4", "detected": "image/jpeg"})
+	assert.Equal(t, metadata.MimeMismatch, msg.Kind)
+	assert.Equal(t, "The file was declared as 'video/mp4', but the content was detected as 'image/jpeg'", msg.Message)
+
+	// Every message in the default catalog should be translated
+	en, nbMessages := DefaultCatalog().messages["en"], DefaultCatalog().messages["nb"]
+	assert.Equal(t, len(en), len(nbMessages))
+	for key := range en {
+		assert.Contains(t, nbMessages, key)
+	}
+}
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	tusd "github.com/tus/tusd/pkg/handler"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("the checksum of the file does not match the checksum provided by the client")
+)
+
+// Codes used in metadata.CheckSum.Code by the ChecksumVerifier
+const (
+	ChecksumMatched     = "matched"
+	ChecksumMismatched  = "mismatched"
+	ChecksumUnsupported = "unsupported"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"MD5":     md5.New,
+	"SHA1":    sha1.New,
+	"SHA256":  sha256.New,
+	"SHA512":  sha512.New,
+	"SHA3256": sha3.New256,
+	"SHA3512": sha3.New512,
+}
+
+// Normalizes the checksumType, so that 'sha-256' and 'SHA256' are treated equally.
+func normalizeChecksumType(kind string) string {
+	kind = strings.ToUpper(strings.TrimSpace(kind))
+	return strings.NewReplacer("-", "", "_", "", " ", "").Replace(kind)
+}
+
+// Reports whether a checksumType, as used in metadata.MetaChecksum, can be verified.
+func ChecksumSupported(kind string) bool {
+	_, ok := checksumAlgorithms[normalizeChecksumType(kind)]
+	return ok
+}
+
+// ChecksumVerifier calculates the checksums declared by the client while the file streams in.
+//
+// It implements io.Writer, so it can be used with io.TeeReader or io.MultiWriter when writing chunks.
+type ChecksumVerifier struct {
+	declared []metadata.MetaChecksum
+	hashes   map[string]hash.Hash
+	// Algorithms that could not be resumed from a previous state
+	lost map[string]bool
+	// The number of bytes of the upload that have been hashed
+	offset int64
+}
+
+// Creates a ChecksumVerifier for the checksums declared by the client. Unsupported algorithms are ignored,
+// but will be reported as such.
+func NewChecksumVerifier(declared []metadata.MetaChecksum) *ChecksumVerifier {
+	c := &ChecksumVerifier{
+		declared: declared,
+		hashes:   map[string]hash.Hash{},
+		lost:     map[string]bool{},
+	}
+	for _, d := range declared {
+		kind := normalizeChecksumType(d.ChecksumType)
+		if fn, ok := checksumAlgorithms[kind]; ok {
+			c.hashes[kind] = fn()
+		}
+	}
+	return c
+}
+
+func (c *ChecksumVerifier) Write(p []byte) (int, error) {
+	for _, h := range c.hashes {
+		h.Write(p)
+	}
+	c.offset += int64(len(p))
+	return len(p), nil
+}
+
+// Gives up on every algorithm, as the state needed to resume them is missing.
+func (c *ChecksumVerifier) loseAll() {
+	for kind := range c.hashes {
+		c.lost[kind] = true
+	}
+	c.hashes = map[string]hash.Hash{}
+}
+
+// The state of a ChecksumVerifier, and the offset of the upload it was taken at.
+type checksumState struct {
+	Offset int64
+	Hashes map[string][]byte
+}
+
+// Returns the state of the verifier, so that the calculation can be resumed in a later request.
+// Algorithms that cannot be serialized are left out, and will be reported as unsupported when restored.
+func (c *ChecksumVerifier) MarshalBinary() ([]byte, error) {
+	state := checksumState{Offset: c.offset, Hashes: map[string][]byte{}}
+	for kind, h := range c.hashes {
+		m, ok := h.(encoding.BinaryMarshaler)
+		if !ok {
+			continue
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal state for checksum '%s': %w", kind, err)
+		}
+		state.Hashes[kind] = b
+	}
+	return json.Marshal(state)
+}
+
+// Restores a state previously returned by MarshalBinary.
+func (c *ChecksumVerifier) UnmarshalBinary(b []byte) error {
+	var state checksumState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("failed to unmarshal checksum-state: %w", err)
+	}
+	c.offset = state.Offset
+	for kind, h := range c.hashes {
+		s, ok := state.Hashes[kind]
+		if !ok {
+			delete(c.hashes, kind)
+			c.lost[kind] = true
+			continue
+		}
+		u, ok := h.(encoding.BinaryUnmarshaler)
+		if !ok {
+			delete(c.hashes, kind)
+			c.lost[kind] = true
+			continue
+		}
+		if err := u.UnmarshalBinary(s); err != nil {
+			return fmt.Errorf("failed to unmarshal state for checksum '%s': %w", kind, err)
+		}
+	}
+	return nil
+}
+
+// Persists the current state with Persistence.SetTemporaryChecksum
+func (c *ChecksumVerifier) SaveState(p Persistence, id string) error {
+	b, err := c.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return p.SetTemporaryChecksum(id, b)
+}
+
+// Creates a ChecksumVerifier for the upload, and resumes any state stored with SaveState.
+//
+// A state taken at another offset than that of the upload is discarded, e.g. when a chunk was hashed but the
+// offset was never committed, as resuming it would hash those bytes twice.
+func RestoreChecksumVerifier(p Persistence, info tusd.FileInfo) (*ChecksumVerifier, error) {
+	c := NewChecksumVerifier(metadata.GetUploadMetadata(info).Checksum)
+	if info.Offset == 0 {
+		return c, nil
+	}
+	b, err := p.GetTemporaryChecksum(info.ID)
+	if err != nil {
+		return c, err
+	}
+	if len(b) == 0 {
+		// Without a state, nothing can be verified for this upload.
+		c.loseAll()
+		return c, nil
+	}
+	if err := c.UnmarshalBinary(b); err != nil {
+		return c, err
+	}
+	if c.offset != info.Offset {
+		c.loseAll()
+		c.offset = info.Offset
+	}
+	return c, nil
+}
+
+// Compares the calculated checksums with the ones declared by the client.
+//
+// If any checksum mismatched, that checksum is returned with the code ChecksumMismatched. Otherwise, the first
+// matching checksum is returned. If none of the declared checksums could be verified, the code is ChecksumUnsupported.
+// The Notes-field lists the outcome for every declared checksum.
+func (c *ChecksumVerifier) Verify() metadata.CheckSum {
+	var (
+		result metadata.CheckSum
+		notes  []string
+	)
+	for _, d := range c.declared {
+		kind := normalizeChecksumType(d.ChecksumType)
+		h, ok := c.hashes[kind]
+		if !ok {
+			note := ChecksumUnsupported
+			if c.lost[kind] {
+				note = "could not be resumed"
+			}
+			notes = append(notes, fmt.Sprintf("%s: %s", d.ChecksumType, note))
+			continue
+		}
+		value := hex.EncodeToString(h.Sum(nil))
+		if strings.EqualFold(value, strings.TrimSpace(d.Value)) {
+			notes = append(notes, fmt.Sprintf("%s: %s", d.ChecksumType, ChecksumMatched))
+			if result.Code == "" {
+				result = metadata.CheckSum{Value: value, Kind: d.ChecksumType, Code: ChecksumMatched}
+			}
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("%s: %s", d.ChecksumType, ChecksumMismatched))
+		if result.Code != ChecksumMismatched {
+			result = metadata.CheckSum{Value: value, Kind: d.ChecksumType, Code: ChecksumMismatched}
+		}
+	}
+	if result.Code == "" {
+		result.Code = ChecksumUnsupported
+	}
+	result.Notes = strings.Join(notes, "; ")
+	return result
+}
+
+// Verifies the checksums, and stores the result as the ReceiverChecksum, both in Persistence and on the metadata.
+// ErrChecksumMismatch is returned if any of the checksums mismatched.
+func (c *ChecksumVerifier) Store(p Persistence, id string, data *metadata.Metadata) (metadata.CheckSum, error) {
+	cs := c.Verify()
+	if _, err := data.SetReceiverChecksum(cs.Value, cs.Kind, cs.Code, cs.Notes); err != nil {
+		return cs, err
+	}
+	if err := p.SetReceiverChecksum(id, cs); err != nil {
+		return cs, err
+	}
+	if cs.Code == ChecksumMismatched {
+		return cs, fmt.Errorf("%w: %s", ErrChecksumMismatch, cs.Notes)
+	}
+	return cs, nil
+}
+
+// Can be implemented by connectors to handle uploads where the ReceiverChecksum mismatched.
+// If not implemented, CompleteVerifiedUpload will refuse to complete the upload.
+type ChecksumMismatchHandler interface {
+	HandleChecksumMismatch(info tusd.FileInfo, checkSum metadata.CheckSum) (UploadResult, error)
+}
+
+// Calls UploadCompleter.CompleteUpload, unless the ReceiverChecksum of the upload mismatched.
+// In that case, the mismatch is passed to the connector, if it implements ChecksumMismatchHandler,
+// or ErrChecksumMismatch is returned.
+func CompleteVerifiedUpload(uc UploadCompleter, info tusd.FileInfo) (UploadResult, error) {
+	data := metadata.Metadata(info.MetaData)
+	cs, err := data.GetReceiverChecksum()
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if cs.Code != ChecksumMismatched {
+		return uc.CompleteUpload(info)
+	}
+	if h, ok := uc.(ChecksumMismatchHandler); ok {
+		return h.HandleChecksumMismatch(info, cs)
+	}
+	return UploadResult{}, fmt.Errorf("%w: %s", ErrChecksumMismatch, cs.Notes)
+}
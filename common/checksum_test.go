@@ -0,0 +1,108 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+const (
+	abcSha256  = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	abcSha3256 = "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"
+)
+
+func TestChecksumVerifier_Verify(t *testing.T) {
+	tests := []struct {
+		name     string
+		declared []metadata.MetaChecksum
+		wantCode string
+		wantKind string
+	}{
+		{"matched", []metadata.MetaChecksum{{Value: abcSha256, ChecksumType: "SHA256"}, {Value: abcSha3256, ChecksumType: "SHA3-256"}}, ChecksumMatched, "SHA256"},
+		{"case-insensitive", []metadata.MetaChecksum{{Value: "BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD", ChecksumType: "sha-256"}}, ChecksumMatched, "sha-256"},
+		{"mismatched", []metadata.MetaChecksum{{Value: abcSha256, ChecksumType: "SHA256"}, {Value: abcSha256, ChecksumType: "SHA3-256"}}, ChecksumMismatched, "SHA3-256"},
+		{"unsupported", []metadata.MetaChecksum{{Value: "abc", ChecksumType: "Blake3"}}, ChecksumUnsupported, ""},
+		{"none declared", nil, ChecksumUnsupported, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecksumVerifier(tt.declared)
+			c.Write([]byte("a"))
+			c.Write([]byte("bc"))
+			got := c.Verify()
+			assert.Equal(t, tt.wantCode, got.Code)
+			assert.Equal(t, tt.wantKind, got.Kind)
+		})
+	}
+}
+
+func TestChecksumVerifier_Resume(t *testing.T) {
+	p := newMemoryPersistence()
+	um := metadata.UploadMetadata{Checksum: []metadata.MetaChecksum{{Value: abcSha256, ChecksumType: "SHA256"}, {Value: abcSha3256, ChecksumType: "SHA3-256"}}}
+	info := tusd.FileInfo{ID: "a", MetaData: tusd.MetaData(um.ConvertToMetaData())}
+
+	c, err := RestoreChecksumVerifier(p, info)
+	assert.NoError(t, err)
+	c.Write([]byte("a"))
+	assert.NoError(t, c.SaveState(p, info.ID))
+
+	info.Offset = 1
+	c, err = RestoreChecksumVerifier(p, info)
+	assert.NoError(t, err)
+	c.Write([]byte("bc"))
+
+	data := metadata.Metadata(info.MetaData)
+	cs, err := c.Store(p, info.ID, &data)
+	assert.NoError(t, err)
+	assert.Equal(t, ChecksumMatched, cs.Code)
+	// Both hashes must have survived the resume, not only SHA256
+	assert.Equal(t, "SHA256: matched; SHA3-256: matched", cs.Notes)
+	assert.Equal(t, cs, p.checksums[info.ID])
+	stored, err := data.GetReceiverChecksum()
+	assert.NoError(t, err)
+	assert.Equal(t, cs, stored)
+}
+
+func TestChecksumVerifier_ResumeUncommitted(t *testing.T) {
+	p := newMemoryPersistence()
+	um := metadata.UploadMetadata{Checksum: []metadata.MetaChecksum{{Value: abcSha256, ChecksumType: "SHA256"}}}
+	info := tusd.FileInfo{ID: "a", MetaData: tusd.MetaData(um.ConvertToMetaData())}
+
+	c := NewChecksumVerifier(um.Checksum)
+	c.Write([]byte("a"))
+	c.Write([]byte("b"))
+	assert.NoError(t, c.SaveState(p, info.ID))
+
+	// Only "a" was committed, so the state, which includes "b", cannot be resumed
+	info.Offset = 1
+	c, err := RestoreChecksumVerifier(p, info)
+	assert.NoError(t, err)
+	c.Write([]byte("bc"))
+	cs := c.Verify()
+	assert.Equal(t, ChecksumUnsupported, cs.Code)
+	assert.Equal(t, "SHA256: could not be resumed", cs.Notes)
+}
+
+type completer struct{ called bool }
+
+func (c *completer) CompleteUpload(info tusd.FileInfo) (UploadResult, error) {
+	c.called = true
+	return UploadResult{Confirmed: UploadConfirmedComplete}, nil
+}
+
+func TestCompleteVerifiedUpload(t *testing.T) {
+	data := metadata.Metadata{}
+	data.SetReceiverChecksum("abc", "SHA256", ChecksumMismatched, "SHA256: mismatched")
+	uc := &completer{}
+	_, err := CompleteVerifiedUpload(uc, tusd.FileInfo{MetaData: tusd.MetaData(data)})
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+	assert.False(t, uc.called)
+
+	data.SetReceiverChecksum("abc", "SHA256", ChecksumMatched, "SHA256: matched")
+	_, err = CompleteVerifiedUpload(uc, tusd.FileInfo{MetaData: tusd.MetaData(data)})
+	assert.NoError(t, err)
+	assert.True(t, uc.called)
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// Headers used by the tus checksum-extension
+const (
+	UploadChecksumHeader       = "Upload-Checksum"
+	TusChecksumAlgorithmHeader = "Tus-Checksum-Algorithm"
+	// Status-code defined by the checksum-extension for chunks that fail verification
+	StatusChecksumMismatch = 460
+)
+
+var (
+	ErrChunkChecksumMismatch        = tusd.NewHTTPError(errors.New("checksum mismatch"), StatusChecksumMismatch)
+	ErrUnsupportedChecksumAlgorithm = tusd.NewHTTPError(errors.New("unsupported checksum algorithm"), http.StatusBadRequest)
+	ErrInvalidUploadChecksum        = tusd.NewHTTPError(errors.New("invalid Upload-Checksum header"), http.StatusBadRequest)
+)
+
+var chunkChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// The algorithms supported for chunk-verification, as advertised in Tus-Checksum-Algorithm
+var ChunkChecksumAlgorithms = []string{"sha1", "sha256", "md5"}
+
+// The largest chunk ChunkChecksumMiddleware holds in memory for verification.
+const DefaultMaxChecksumChunkSize = 64 << 20
+
+// The checksum of a single chunk, as provided in the Upload-Checksum-header.
+type ChunkChecksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// Parses the value of an Upload-Checksum-header, in the format '<algorithm> <base64-encoded checksum>'.
+// Returns nil if the header is empty.
+func ParseUploadChecksum(header string) (*ChunkChecksum, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidUploadChecksum
+	}
+	algorithm := strings.ToLower(parts[0])
+	if _, ok := chunkChecksumAlgorithms[algorithm]; !ok {
+		return nil, ErrUnsupportedChecksumAlgorithm
+	}
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, ErrInvalidUploadChecksum
+	}
+	return &ChunkChecksum{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// Reads the whole chunk, and verifies it against the checksum.
+// The chunk is returned only if it is valid, so that it can be written to the store.
+// Chunks larger than max bytes are rejected with ErrChunkTooLarge.
+func (c ChunkChecksum) Verify(r io.Reader, max int64) ([]byte, error) {
+	fn, ok := chunkChecksumAlgorithms[c.Algorithm]
+	if !ok {
+		return nil, ErrUnsupportedChecksumAlgorithm
+	}
+	h := fn()
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(&buf, h), io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	if n > max {
+		return nil, fmt.Errorf("%w: the maximum is %d bytes when verifying checksums", ErrChunkTooLarge, max)
+	}
+	if !bytes.Equal(h.Sum(nil), c.Sum) {
+		return nil, ErrChunkChecksumMismatch
+	}
+	return buf.Bytes(), nil
+}
+
+// Middleware implementing the tus checksum-extension, holding at most DefaultMaxChecksumChunkSize bytes in memory.
+func ChunkChecksumMiddleware(next http.Handler) http.Handler {
+	return ChunkChecksumLimit(DefaultMaxChecksumChunkSize)(next)
+}
+
+// Returns middleware implementing the tus checksum-extension.
+//
+// The body of PATCH-requests with an Upload-Checksum-header is verified before being passed on to the tusd-handler,
+// so a corrupt chunk never reaches the DataStore, and its offset is never committed with Persistence.SetUploadOffset.
+// Since the chunk is held in memory during verification, chunks above maxChunkSize bytes are rejected with
+// 413 Request Entity Too Large.
+func ChunkChecksumLimit(maxChunkSize int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				w.Header().Set(TusChecksumAlgorithmHeader, strings.Join(ChunkChecksumAlgorithms, ","))
+				next.ServeHTTP(&checksumExtensionWriter{ResponseWriter: w}, r)
+				return
+			}
+			if r.Method != http.MethodPatch {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c, err := ParseUploadChecksum(r.Header.Get(UploadChecksumHeader))
+			if err != nil {
+				writeTusError(w, err)
+				return
+			}
+			if c == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > maxChunkSize {
+				writeTusError(w, fmt.Errorf("%w: the maximum is %d bytes when verifying checksums", ErrChunkTooLarge, maxChunkSize))
+				return
+			}
+			chunk, err := c.Verify(http.MaxBytesReader(w, r.Body, maxChunkSize+1), maxChunkSize)
+			r.Body.Close()
+			if err != nil {
+				writeTusError(w, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(chunk))
+			r.ContentLength = int64(len(chunk))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Adds the checksum-extension to the Tus-Extension-header that tusd sets on OPTIONS-requests.
+type checksumExtensionWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *checksumExtensionWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if ext := w.Header().Get("Tus-Extension"); ext != "" && !contains(strings.Split(ext, ","), "checksum") {
+			w.Header().Set("Tus-Extension", ext+",checksum")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *checksumExtensionWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Writes the error in the same way as the tusd-handler does.
+func writeTusError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var httpErr tusd.HTTPError
+	if errors.As(err, &httpErr) {
+		status = httpErr.StatusCode()
+	}
+	w.Header().Set("Tus-Resumable", "1.0.0")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(err.Error() + "\n"))
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkChecksumMiddleware(t *testing.T) {
+	sum := sha1.Sum([]byte("hello"))
+	valid := "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		name       string
+		header     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"valid chunk is passed on", valid, "hello", http.StatusNoContent, "hello"},
+		{"corrupt chunk is rejected", valid, "hellO", StatusChecksumMismatch, ""},
+		{"unsupported algorithm", "crc32 AAAA", "hello", http.StatusBadRequest, ""},
+		{"invalid header", "sha1", "hello", http.StatusBadRequest, ""},
+		{"no checksum", "", "hello", http.StatusNoContent, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := ChunkChecksumMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				got = string(b)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			r := httptest.NewRequest(http.MethodPatch, "/files/abc", strings.NewReader(tt.body))
+			if tt.header != "" {
+				r.Header.Set(UploadChecksumHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+}
+
+func TestChunkChecksumLimit(t *testing.T) {
+	sum := sha1.Sum([]byte("hello world"))
+	header := "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+	called := false
+	h := ChunkChecksumLimit(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	r := httptest.NewRequest(http.MethodPatch, "/files/abc", strings.NewReader("hello world"))
+	r.Header.Set(UploadChecksumHeader, header)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Without a Content-Length, the body is still limited while it is read
+	r = httptest.NewRequest(http.MethodPatch, "/files/abc", io.MultiReader(strings.NewReader("hello world")))
+	r.ContentLength = -1
+	r.Header.Set(UploadChecksumHeader, header)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.False(t, called)
+}
+
+func TestChunkChecksumMiddleware_Options(t *testing.T) {
+	h := ChunkChecksumMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.WriteHeader(http.StatusOK)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/files/", nil))
+	assert.Equal(t, "creation,termination,checksum", w.Header().Get("Tus-Extension"))
+	assert.Equal(t, "sha1,sha256,md5", w.Header().Get(TusChecksumAlgorithmHeader))
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+var (
+	ErrChunkTooLarge       = tusd.NewHTTPError(errors.New("chunk too large"), http.StatusRequestEntityTooLarge)
+	ErrChunkTooSmall       = tusd.NewHTTPError(errors.New("chunk too small"), http.StatusBadRequest)
+	ErrSingleChunkOnly     = tusd.NewHTTPError(errors.New("the file must be uploaded in a single chunk"), http.StatusBadRequest)
+	ErrChunkLengthRequired = tusd.NewHTTPError(errors.New("Content-Length is required"), http.StatusLengthRequired)
+)
+
+// Enforces MinChunkSize and MaxChunkSize of the ConnectorFeatures on PATCH-requests.
+//
+// The final chunk of an upload may be smaller than MinChunkSize. If MinChunkSize is -1, the whole file must be
+// sent in a single chunk, which requires the length of the upload to be known.
+//
+// Chunks sent without a Content-Length, as with chunked transfer-encoding, are rejected with 411 if MinChunkSize
+// is set, as their size is needed to tell whether they are the final chunk. Otherwise, MaxChunkSize is enforced
+// as the body is read.
+type ChunkSizeEnforcer struct {
+	Features ConnectorFeatures
+	// Returns the upload the request is for. Only called when the size of the upload is needed.
+	Lookup func(r *http.Request) (tusd.FileInfo, error)
+}
+
+// Returns an enforcer looking up uploads in the store, by the last segment of the request-path, as tusd does.
+func NewChunkSizeEnforcer(f ConnectorFeatures, store tusd.DataStore) *ChunkSizeEnforcer {
+	return &ChunkSizeEnforcer{Features: f, Lookup: lookupUpload(store)}
+}
+
+// Returns a lookup of the upload a request is for, by the last segment of the request-path, as tusd does.
+func lookupUpload(store tusd.DataStore) func(r *http.Request) (tusd.FileInfo, error) {
+	return func(r *http.Request) (tusd.FileInfo, error) {
+		upload, err := store.GetUpload(r.Context(), path.Base(strings.TrimSuffix(r.URL.Path, "/")))
+		if err != nil {
+			return tusd.FileInfo{}, err
+		}
+		return upload.GetInfo(r.Context())
+	}
+}
+
+func (e *ChunkSizeEnforcer) enforced() bool {
+	return e.Features.MinChunkSize != 0 || e.Features.MaxChunkSize > 0
+}
+
+// Checks a chunk of length bytes at the offset. The info is only used if it is needed.
+func (e *ChunkSizeEnforcer) Check(offset, length int64, info func() (tusd.FileInfo, error)) error {
+	f := e.Features
+	if f.MaxChunkSize > 0 && length > f.MaxChunkSize {
+		return fmt.Errorf("%w: %d bytes, the maximum is %d bytes", ErrChunkTooLarge, length, f.MaxChunkSize)
+	}
+	if f.MinChunkSize == 0 || (f.MinChunkSize > 0 && length >= f.MinChunkSize) {
+		return nil
+	}
+	upload, err := info()
+	if err != nil {
+		return err
+	}
+	final := !upload.SizeIsDeferred && offset+length == upload.Size
+	if f.MinChunkSize < 0 {
+		if offset != 0 || !final {
+			return ErrSingleChunkOnly
+		}
+		return nil
+	}
+	if !final {
+		return fmt.Errorf("%w: %d bytes, the minimum is %d bytes, except for the final chunk", ErrChunkTooSmall, length, f.MinChunkSize)
+	}
+	return nil
+}
+
+// Rejects PATCH-requests with chunks that violate the chunk-sizes, before they reach tusd.
+func (e *ChunkSizeEnforcer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || !e.enforced() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			// Left to tusd to reject
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength < 0 {
+			if e.Features.MinChunkSize != 0 {
+				writeTusError(w, ErrChunkLengthRequired)
+				return
+			}
+			r.Body = &limitedBody{r: r.Body, remaining: e.Features.MaxChunkSize, exceeded: ErrChunkTooLarge}
+			next.ServeHTTP(w, r)
+			return
+		}
+		err = e.Check(offset, r.ContentLength, func() (tusd.FileInfo, error) {
+			info, err := e.Lookup(r)
+			if os.IsNotExist(err) {
+				// As tusd does
+				return info, tusd.ErrNotFound
+			}
+			if err != nil {
+				return info, err
+			}
+			// The length of a deferred upload may be declared with the chunk
+			if info.SizeIsDeferred {
+				if size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64); err == nil {
+					info.Size = size
+					info.SizeIsDeferred = false
+				}
+			}
+			return info, nil
+		})
+		if err != nil {
+			writeTusError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tus/tusd/pkg/filestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+func TestChunkSizeEnforcerCheck(t *testing.T) {
+	upload := func(size int64) func() (tusd.FileInfo, error) {
+		return func() (tusd.FileInfo, error) { return tusd.FileInfo{Size: size}, nil }
+	}
+	deferred := func() (tusd.FileInfo, error) { return tusd.FileInfo{SizeIsDeferred: true}, nil }
+	tests := []struct {
+		name           string
+		features       ConnectorFeatures
+		offset, length int64
+		info           func() (tusd.FileInfo, error)
+		want           error
+	}{
+		{"unrestricted", ConnectorFeatures{}, 0, 1 << 30, nil, nil},
+		{"within", ConnectorFeatures{MinChunkSize: 10, MaxChunkSize: 20}, 0, 15, nil, nil},
+		{"too large", ConnectorFeatures{MinChunkSize: 10, MaxChunkSize: 20}, 0, 21, nil, ErrChunkTooLarge},
+		{"too small", ConnectorFeatures{MinChunkSize: 10, MaxChunkSize: 20}, 0, 9, upload(100), ErrChunkTooSmall},
+		{"small final chunk", ConnectorFeatures{MinChunkSize: 10, MaxChunkSize: 20}, 95, 5, upload(100), nil},
+		{"small chunk of deferred upload", ConnectorFeatures{MinChunkSize: 10}, 95, 5, deferred, ErrChunkTooSmall},
+		{"single chunk", ConnectorFeatures{MinChunkSize: -1}, 0, 100, upload(100), nil},
+		{"single chunk, partial", ConnectorFeatures{MinChunkSize: -1}, 0, 50, upload(100), ErrSingleChunkOnly},
+		{"single chunk, resumed", ConnectorFeatures{MinChunkSize: -1}, 50, 50, upload(100), ErrSingleChunkOnly},
+		{"single chunk, deferred", ConnectorFeatures{MinChunkSize: -1}, 0, 50, deferred, ErrSingleChunkOnly},
+		{"single chunk, too large", ConnectorFeatures{MinChunkSize: -1, MaxChunkSize: 10}, 0, 100, upload(100), ErrChunkTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ChunkSizeEnforcer{Features: tt.features}
+			err := e.Check(tt.offset, tt.length, tt.info)
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, tt.want), err)
+		})
+	}
+}
+
+func TestChunkSizeEnforcerMiddleware(t *testing.T) {
+	store := filestore.New(t.TempDir())
+	upload, err := store.NewUpload(context.Background(), tusd.FileInfo{ID: "abc", Size: 100})
+	assert.NoError(t, err)
+	info, _ := upload.GetInfo(context.Background())
+
+	e := NewChunkSizeEnforcer(ConnectorFeatures{MinChunkSize: 10, MaxChunkSize: 50}, store)
+	h := e.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	patch := func(offset, length int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPatch, "/files/"+info.ID, strings.NewReader(strings.Repeat("a", length)))
+		r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusNoContent, patch(0, 50).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, patch(0, 51).Code)
+	w := patch(0, 5)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "1.0.0", w.Header().Get("Tus-Resumable"))
+	assert.Contains(t, w.Body.String(), "chunk too small")
+	assert.Equal(t, http.StatusNoContent, patch(95, 5).Code)
+
+	r := httptest.NewRequest(http.MethodPatch, "/files/"+info.ID, strings.NewReader("a"))
+	r.Header.Set("Upload-Offset", "0")
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusLengthRequired, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/files/"+info.ID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	r = httptest.NewRequest(http.MethodPatch, "/files/missing", strings.NewReader("a"))
+	r.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestChunkSizeEnforcerMiddleware_Chunked(t *testing.T) {
+	e := &ChunkSizeEnforcer{Features: ConnectorFeatures{MaxChunkSize: 10}}
+	h := e.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			writeTusError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	patch := func(length int) int {
+		r := httptest.NewRequest(http.MethodPatch, "/files/abc", strings.NewReader(strings.Repeat("a", length)))
+		r.Header.Set("Upload-Offset", "0")
+		r.ContentLength = -1
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNoContent, patch(10))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, patch(11))
+}
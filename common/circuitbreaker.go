@@ -0,0 +1,338 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("the backend is unavailable")
+)
+
+type CircuitState string
+
+const (
+	// Calls are passed through to the backend
+	CircuitClosed CircuitState = "closed"
+	// Calls are short-circuited, without reaching the backend
+	CircuitOpen CircuitState = "open"
+	// A single trial-call is allowed through, to check if the backend has recovered
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+type CircuitBreakerOptions struct {
+	// The number of consecutive failures before the circuit opens. Defaults to 5
+	FailureThreshold int
+	// How long the circuit stays open before allowing a trial-call. Defaults to 30 seconds
+	OpenDuration time.Duration
+}
+
+// CircuitBreaker short-circuits calls to a connector's backend while it is down.
+//
+// The circuit opens after consecutive failures, or when a health-report says the backend is down.
+type CircuitBreaker struct {
+	ConnectorId string
+	options     CircuitBreakerOptions
+	mu          sync.Mutex
+	state       CircuitState
+	failures    int
+	openedAt    time.Time
+	lastErr     error
+	trial       bool
+	trialAt     time.Time
+	now         func() time.Time
+}
+
+func NewCircuitBreaker(connectorId string, o CircuitBreakerOptions) *CircuitBreaker {
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = 5
+	}
+	if o.OpenDuration <= 0 {
+		o.OpenDuration = 30 * time.Second
+	}
+	return &CircuitBreaker{
+		ConnectorId: connectorId,
+		options:     o,
+		state:       CircuitClosed,
+		now:         time.Now,
+	}
+}
+
+// Returns the current state. An open circuit becomes half-open once OpenDuration has passed.
+func (c *CircuitBreaker) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentState()
+}
+
+func (c *CircuitBreaker) currentState() CircuitState {
+	if c.state == CircuitOpen && !c.now().Before(c.openedAt.Add(c.options.OpenDuration)) {
+		c.state = CircuitHalfOpen
+		c.trial = false
+	}
+	return c.state
+}
+
+// The time at which the circuit will allow calls again. Zero if the circuit is not open.
+func (c *CircuitBreaker) RetryAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.currentState() != CircuitOpen {
+		return time.Time{}
+	}
+	return c.openedAt.Add(c.options.OpenDuration)
+}
+
+// Returns an error wrapping ErrCircuitOpen if the call should not reach the backend.
+// Every allowed call must be followed by a call to Success or Failure. If the outcome of a trial-call is never
+// reported, another trial-call is allowed after OpenDuration, so that the circuit cannot stay half-open forever.
+func (c *CircuitBreaker) Allow() error {
+	_, err := c.allow()
+	return err
+}
+
+// Like Allow, but also returns the time at which a call may be allowed again.
+func (c *CircuitBreaker) allow() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.currentState() {
+	case CircuitOpen:
+		retryAt := c.openedAt.Add(c.options.OpenDuration)
+		return retryAt, c.openErr(retryAt)
+	case CircuitHalfOpen:
+		if retryAt := c.trialAt.Add(c.options.OpenDuration); c.trial && c.now().Before(retryAt) {
+			return retryAt, c.openErr(retryAt)
+		}
+		c.trial = true
+		c.trialAt = c.now()
+	}
+	return time.Time{}, nil
+}
+
+func (c *CircuitBreaker) openErr(retryAt time.Time) error {
+	if c.lastErr != nil {
+		return fmt.Errorf("%w: connector '%s' is unavailable until %s: %s", ErrCircuitOpen, c.ConnectorId, retryAt.Format(time.RFC3339), c.lastErr)
+	}
+	return fmt.Errorf("%w: connector '%s' is unavailable until %s", ErrCircuitOpen, c.ConnectorId, retryAt.Format(time.RFC3339))
+}
+
+func (c *CircuitBreaker) Success() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = CircuitClosed
+	c.failures = 0
+	c.trial = false
+	c.lastErr = nil
+}
+
+func (c *CircuitBreaker) Failure(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	c.failures++
+	if c.currentState() == CircuitHalfOpen || c.failures >= c.options.FailureThreshold {
+		c.open()
+	}
+}
+
+func (c *CircuitBreaker) open() {
+	c.state = CircuitOpen
+	c.openedAt = c.now()
+	c.trial = false
+}
+
+// Runs fn if the circuit allows it, and records the outcome.
+// Errors caused by the input, like ErrInvalidSearch, show that the backend could be reached, and count as successes.
+func (c *CircuitBreaker) Do(fn func() error) error {
+	if err := c.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	if err != nil && !inputError(err) {
+		c.Failure(err)
+		return err
+	}
+	c.Success()
+	return err
+}
+
+// Reports whether the error is caused by the input to a call, rather than by the backend.
+func inputError(err error) bool {
+	for _, e := range []error{
+		ErrInvalidSearch,
+		ErrUnsupportedSearch,
+		ErrUnsupportedValidation,
+		ErrForbidden,
+		ErrImpersonationDenied,
+		ErrNoCredentials,
+		ErrInvalidCredentials,
+	} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Feeds the result of a health-report into the circuit.
+// A backend that is down opens the circuit immediately, while a healthy backend lets an open circuit half-open.
+func (c *CircuitBreaker) ObserveHealth(status HealthStatus, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch status {
+	case HealthDown:
+		if err != nil {
+			c.lastErr = err
+		}
+		if c.currentState() != CircuitOpen {
+			c.open()
+		}
+	case HealthOK:
+		if c.currentState() == CircuitOpen {
+			c.state = CircuitHalfOpen
+			c.trial = false
+		}
+	}
+}
+
+// Reports the state of the circuit as a HealthCheck.
+func (c *CircuitBreaker) HealthCheck() HealthCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	check := HealthCheck{
+		Name:    "circuit",
+		Status:  HealthOK,
+		Message: string(c.currentState()),
+	}
+	switch c.state {
+	case CircuitOpen:
+		check.Status = HealthDown
+		check.Message = fmt.Sprintf("%s until %s", c.state, c.openedAt.Add(c.options.OpenDuration).Format(time.RFC3339))
+	case CircuitHalfOpen:
+		check.Status = HealthDegraded
+	}
+	if c.lastErr != nil && c.state != CircuitClosed {
+		check.Message += ": " + c.lastErr.Error()
+	}
+	return check
+}
+
+type circuitHealthReporter struct {
+	DetailedHealthReporter
+	c *CircuitBreaker
+}
+
+// Wraps the connector's health-reporting, so that the results are fed into the circuit,
+// and the state of the circuit is included in the report.
+// The connector must implement DetailedHealthReporter or HealthReporter.
+func (c *CircuitBreaker) WrapHealthReporter(connector interface{}) (DetailedHealthReporter, bool) {
+	var r DetailedHealthReporter
+	switch h := connector.(type) {
+	case DetailedHealthReporter:
+		r = h
+	case HealthReporter:
+		r = AdaptHealthReporter(h)
+	default:
+		return nil, false
+	}
+	return circuitHealthReporter{r, c}, true
+}
+
+func (r circuitHealthReporter) GetHealthReport(ctx context.Context) HealthReport {
+	report := r.DetailedHealthReporter.GetHealthReport(ctx)
+	var err error
+	for _, check := range report.Checks {
+		if check.Status == HealthDown && check.Message != "" {
+			err = errors.New(check.Message)
+			break
+		}
+	}
+	r.c.ObserveHealth(CombineHealthStatus(report.Checks), err)
+	report.Checks = append(report.Checks, r.c.HealthCheck())
+	report.Status = CombineHealthStatus(report.Checks)
+	return report
+}
+
+// Polls the HealthReporter at the interval, feeding the results into the circuit, until the context is done.
+func (c *CircuitBreaker) Poll(ctx context.Context, h HealthReporter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		code, err := h.GetHealth()
+		switch {
+		case err != nil:
+			c.ObserveHealth(HealthDown, err)
+		case code != http.StatusOK:
+			c.ObserveHealth(HealthDown, fmt.Errorf("health-check reported status %d", code))
+		default:
+			c.ObserveHealth(HealthOK, nil)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Validator that short-circuits while the backend is unavailable.
+type CircuitValidator struct {
+	Validator
+	Circuit *CircuitBreaker
+}
+
+func (v CircuitValidator) Validate(r *http.Request, a AuthenticationPayload, p ValidatePayload) (ValidateResponse, error) {
+	var res ValidateResponse
+	err := v.Circuit.Do(func() (err error) {
+		res, err = v.Validator.Validate(r, a, p)
+		return err
+	})
+	return res, err
+}
+
+// SearchHandler that short-circuits while the backend is unavailable.
+type CircuitSearchHandler struct {
+	SearchHandler
+	Circuit *CircuitBreaker
+}
+
+func (s CircuitSearchHandler) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	return s.SearchContext(context.Background(), a, in)
+}
+
+// Passes the context on, if the wrapped handler implements ContextSearchHandler.
+func (s CircuitSearchHandler) SearchContext(ctx context.Context, a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	var res SearchResult
+	err := s.Circuit.Do(func() (err error) {
+		res, err = searchContext(ctx, s.SearchHandler, a, in)
+		return err
+	})
+	return res, err
+}
+
+// QueueHandler that does not reach the backend while it is unavailable.
+//
+// While the circuit is open, items are postponed until the circuit allows a trial-call, without counting as an
+// attempt, so that an outage does not make items back off. Only results with BackendUnavailable count as failures, as other errors are specific to the
+// item, and show that the backend could be reached.
+type CircuitQueueHandler struct {
+	QueueHandler
+	Circuit *CircuitBreaker
+}
+
+func (q CircuitQueueHandler) HandleQueue(qi QueueItem) QueueRunResult {
+	if retryAt, err := q.Circuit.allow(); err != nil {
+		return QueueRunResult{Err: err.Error(), BackendUnavailable: true, RetryAt: retryAt}
+	}
+	res := q.QueueHandler.HandleQueue(qi)
+	if res.BackendUnavailable {
+		q.Circuit.Failure(errors.New(res.Err))
+		return res
+	}
+	q.Circuit.Success()
+	return res
+}
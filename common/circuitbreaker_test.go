@@ -0,0 +1,103 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2021, 5, 12, 0, 0, 0, 0, time.UTC)
+	c := NewCircuitBreaker("test", CircuitBreakerOptions{FailureThreshold: 2, OpenDuration: time.Minute})
+	c.now = func() time.Time { return now }
+	failing := func() error { return errors.New("timeout") }
+
+	assert.Error(t, c.Do(failing))
+	assert.Equal(t, CircuitClosed, c.State())
+	assert.Error(t, c.Do(failing))
+	assert.Equal(t, CircuitOpen, c.State())
+
+	err := c.Do(func() error { t.Fatal("should not be called while open"); return nil })
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, now.Add(time.Minute), c.RetryAt())
+	assert.Equal(t, HealthDown, c.HealthCheck().Status)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, CircuitHalfOpen, c.State())
+	assert.NoError(t, c.Allow())
+	assert.True(t, errors.Is(c.Allow(), ErrCircuitOpen), "only a single trial-call is allowed")
+	c.Failure(errors.New("still down"))
+	assert.Equal(t, CircuitOpen, c.State())
+
+	c.ObserveHealth(HealthOK, nil)
+	assert.Equal(t, CircuitHalfOpen, c.State())
+	assert.NoError(t, c.Do(func() error { return nil }))
+	assert.Equal(t, CircuitClosed, c.State())
+
+	c.ObserveHealth(HealthDown, errors.New("unreachable"))
+	assert.Equal(t, CircuitOpen, c.State())
+}
+
+type queueHandler struct {
+	calls int
+	res   QueueRunResult
+}
+
+func (q *queueHandler) HandleQueue(qi QueueItem) QueueRunResult {
+	q.calls++
+	return q.res
+}
+func (q *queueHandler) GetQueueHandlerId() string { return "test" }
+
+func TestCircuitQueueHandler(t *testing.T) {
+	now := time.Date(2021, 5, 12, 0, 0, 0, 0, time.UTC)
+	c := NewCircuitBreaker("test", CircuitBreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute})
+	c.now = func() time.Time { return now }
+	qh := &queueHandler{res: QueueRunResult{Err: "invalid case-number", Backoff: true}}
+	h := CircuitQueueHandler{qh, c}
+
+	// Errors specific to the item do not open the circuit
+	h.HandleQueue(QueueItem{})
+	assert.Equal(t, CircuitClosed, c.State())
+
+	qh.res = QueueRunResult{Err: "backend down", BackendUnavailable: true}
+	h.HandleQueue(QueueItem{})
+	assert.Equal(t, CircuitOpen, c.State())
+	res := h.HandleQueue(QueueItem{})
+	assert.Equal(t, 2, qh.calls)
+	assert.True(t, res.BackendUnavailable)
+	assert.Contains(t, res.Err, ErrCircuitOpen.Error())
+	assert.Equal(t, now.Add(time.Minute), res.RetryAt)
+}
+
+func TestCircuitSearchHandler_InputErrors(t *testing.T) {
+	c := NewCircuitBreaker("test", CircuitBreakerOptions{FailureThreshold: 1})
+	sh := &staticSearcher{err: fmt.Errorf("%w: unknown kind", ErrInvalidSearch)}
+	h := CircuitSearchHandler{sh, c}
+
+	_, err := h.Search(AuthenticationPayload{}, SearchInput{})
+	assert.True(t, errors.Is(err, ErrInvalidSearch))
+	assert.Equal(t, CircuitClosed, c.State())
+
+	sh.err = errors.New("timeout")
+	_, err = h.Search(AuthenticationPayload{}, SearchInput{})
+	assert.Error(t, err)
+	assert.Equal(t, CircuitOpen, c.State())
+}
+
+func TestCircuitBreaker_UnreportedTrial(t *testing.T) {
+	now := time.Date(2021, 5, 12, 0, 0, 0, 0, time.UTC)
+	c := NewCircuitBreaker("test", CircuitBreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute})
+	c.now = func() time.Time { return now }
+	c.Failure(errors.New("timeout"))
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, c.Allow())
+	assert.Error(t, c.Allow())
+	// The outcome of the trial is never reported
+	now = now.Add(time.Minute)
+	assert.NoError(t, c.Allow())
+}
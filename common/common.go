@@ -26,12 +26,16 @@ type S3Config struct {
 type S3ConfigOptions struct {
 	CalculateSha bool
 	VerifyMime   bool
+	// Rejects the upload if VerifyMime detects a mismatch. Otherwise, the mismatch is only reported to the client.
+	StrictMime bool
 }
 
 type UploadCompleteStatus string
 
 const (
 	UploadConfirmedComplete UploadCompleteStatus = "Confirmed"
+	// The update is queued, as the backend is unavailable
+	UploadUpdateQueued UploadCompleteStatus = "Queued"
 )
 
 type BaseConfig struct {
@@ -93,7 +97,7 @@ type StoreCreator interface {
 }
 
 type HealthReporter interface {
-	// Should report 200 if ok
+	// Should report 200 if ok. See DetailedHealthReporter for reporting each dependency.
 	GetHealth() (int, error)
 }
 
@@ -111,6 +115,12 @@ type QueueRunResult struct {
 	Backoff bool
 	// Additional info for the current error
 	Err string
+	// Set to true if the error is because the backend is unavailable, rather than specific to the item.
+	// Used by CircuitQueueHandler to open the circuit.
+	BackendUnavailable bool
+	// If set, the item is postponed until this time, without counting as an attempt.
+	// Used by CircuitQueueHandler while the circuit is open.
+	RetryAt time.Time
 }
 
 // Will be called before the actual upload is created. (tusd.DataStore.NewUpload)
@@ -128,6 +138,12 @@ type UploadCompleter interface {
 	CompleteUpload(info tusd.FileInfo) (UploadResult, error)
 }
 
+// Will be called when the client updates the metadata of an upload. See ApplyMetadataUpdate.
+// Return an error wrapping ErrDeferUpdate if the backend is unavailable, and the update will be retried from the queue.
+type UploadMetadataUpdater interface {
+	UpdateMetadata(ctx context.Context, info tusd.FileInfo, update MetadataUpdate) (UploadResult, error)
+}
+
 type GetAllOptions struct {
 	ID               string
 	Limit            int
@@ -174,23 +190,6 @@ type UploadResult struct {
 	ClientMediaId    string `json:"ClientId"`
 }
 
-// Deprecated, please use context-package instead
-func (a *AuthenticationPayload) SetAuthenticationPayloadOnMetadata(m *metadata.Metadata) *metadata.Metadata {
-	if a.ClientId != "" {
-		m.SetClientId(a.ClientId)
-	}
-	if a.UserName != "" {
-		m.SetAsUserName(a.UserName)
-	}
-	if a.UserSid != "" {
-		m.SetAsActiveDirectoryUserSid(a.UserSid)
-	}
-	if a.UserId != "" {
-		m.SetAsUserId(a.UserId)
-	}
-	return m
-}
-
 func AddIds(l logrus.FieldLogger, info tusd.FileInfo) logrus.FieldLogger {
 	data := metadata.Metadata(info.MetaData)
 	return l.WithFields(map[string]interface{}{
@@ -225,12 +224,38 @@ type Validator interface {
 	Validate(r *http.Request, a AuthenticationPayload, v ValidatePayload) (ValidateResponse, error)
 }
 
+// Can be implemented by connectors that can validate many payloads at once.
+// Validators that do not implement it are handled by BatchValidatorAdapter.
+type BatchValidator interface {
+	// Returns a response for each payload, in the same order.
+	ValidateBatch(r *http.Request, a AuthenticationPayload, v []ValidatePayload) ([]ValidateNullableResponse, error)
+}
+
 type ConnectorFeatures struct {
 	// The minimum chunk-size to allow. Setting this to -1 disallows chunks, and all files must be uploaded in a single chunk.
 	MinChunkSize int64
 	// The maximum chunk-size to allow.
 	MaxChunkSize int64
-}
+	// The maximum file-size to allow. Zero means unlimited.
+	MaxFileSize int64 `json:",omitempty"`
+	// The accepted mime-types, like 'video/mp4' or 'video/*'. Empty accepts all.
+	MimeTypes []string `json:",omitempty"`
+	// The checksum-algorithms the connector verifies, like 'sha256'.
+	ChecksumAlgorithms []string `json:",omitempty"`
+	// Whether the metadata can be updated after the upload has completed.
+	MetadataUpdates bool `json:",omitempty"`
+	// Whether uploads can be deleted.
+	Deletion bool `json:",omitempty"`
+	// Whether the UploadResult is returned when the upload completes, or arrives later. Defaults to ResultsSync.
+	Results ResultDelivery `json:",omitempty"`
+}
+
+type ResultDelivery string
+
+const (
+	ResultsSync  ResultDelivery = "sync"
+	ResultsAsync ResultDelivery = "async"
+)
 
 // Can be used to issue what features should be enabled
 type FeatureAnnouncer interface {
@@ -350,6 +375,8 @@ type SearchResultItem struct {
 	DisplayName    string `json:",omitempty"`
 	AltID          string `json:",omitempty"`
 	AltDisplayName string `json:",omitempty"`
+	// The connector the item was found in. Set by FederatedSearchHandler
+	ConnectorId string `json:",omitempty"`
 }
 
 type HasMore string
@@ -364,6 +391,8 @@ type SearchAggregate struct {
 	Offset  int
 	HasMore HasMore            `json:",omitempty"`
 	Items   []SearchResultItem `json:",omitempty"`
+	// Passed as SearchInput.Cursor to get the next page, if the connector supports cursors
+	NextCursor string `json:",omitempty"`
 }
 
 type SearchResult struct {
@@ -371,16 +400,36 @@ type SearchResult struct {
 	Parent *SearchAggregate `json:",omitempty"`
 	Case   *SearchAggregate `json:",omitempty"`
 	Group  *SearchAggregate `json:",omitempty"`
+	// Connectors that failed, when searching multiple connectors.
+	Errors []SearchError `json:",omitempty"`
+}
+
+type SearchError struct {
+	ConnectorId string
+	Message     string
 }
 
 type SearchInput struct {
 	Query string
-	Kind  string
+	// If set, only this kind is searched. Must be enabled in SupportedSearches.
+	Kind  SearchKind
 	Limit int
+	// The number of items to skip. Cannot be combined with Cursor
+	Offset int
+	// The NextCursor of a previous SearchAggregate
+	Cursor string
+	// Narrows the search on other fields, e.g. cases with a name containing X for a given user.
+	Filters []SearchFilter
+	// Sorted in order. Defaults to relevance
+	Sort []SearchSort
 }
 
 type SearchOptions struct {
 	RequiresAuthentication bool
+	// The fields the connector can sort by. Sorting by relevance is always supported
+	SortFields []SearchSortField
+	// Whether the connector returns NextCursor, and accepts SearchInput.Cursor
+	SupportsCursor bool
 }
 
 type SearchHandler interface {
@@ -388,6 +437,21 @@ type SearchHandler interface {
 	SearchCacheKey(AuthenticationPayload, SearchInput) string
 	SearchableFields() (*SupportedSearches, SearchOptions)
 }
+
+// Optional for SearchHandlers. The context is cancelled when the caller stops waiting for the result,
+// e.g. when a FederatedSearchHandler times out.
+type ContextSearchHandler interface {
+	SearchContext(context.Context, AuthenticationPayload, SearchInput) (SearchResult, error)
+}
+
+// Searches with the context if the handler implements ContextSearchHandler.
+func searchContext(ctx context.Context, h SearchHandler, a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	if ch, ok := h.(ContextSearchHandler); ok {
+		return ch.SearchContext(ctx, a, in)
+	}
+	return h.Search(a, in)
+}
+
 type SupportedSearches struct {
 	UserID     bool `json:",omitempty"`
 	UserName   bool `json:",omitempty"`
@@ -402,29 +466,8 @@ type SupportedSearches struct {
 
 func (s *SupportedSearches) MapEnabled() map[string]bool {
 	a := map[string]bool{}
-	if s.UserID {
-		a["UserID"] = true
-	}
-	if s.UserName {
-		a["UserName"] = true
-	}
-	if s.Sid {
-		a["Sid"] = true
-	}
-	if s.ParentName {
-		a["ParentName"] = true
-	}
-	if s.CaseID {
-		a["CaseID"] = true
-	}
-	if s.CaseName {
-		a["CaseName"] = true
-	}
-	if s.GroupName {
-		a["GroupName"] = true
-	}
-	if s.GroupID {
-		a["GroupID"] = true
+	for _, kind := range s.Enabled() {
+		a[string(kind)] = true
 	}
 	return a
 }
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// In-memory Persistence, for use in tests
+type memoryPersistence struct {
+	sync.Mutex
+	values    map[string][]byte
+	checksums map[string]metadata.CheckSum
+	tmp       map[string][]byte
+	infos     map[string]tusd.FileInfo
+}
+
+func newMemoryPersistence() *memoryPersistence {
+	return &memoryPersistence{
+		values:    map[string][]byte{},
+		checksums: map[string]metadata.CheckSum{},
+		tmp:       map[string][]byte{},
+		infos:     map[string]tusd.FileInfo{},
+	}
+}
+
+func (p *memoryPersistence) Set(k string, v interface{}) error {
+	p.Lock()
+	defer p.Unlock()
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.values[k] = b
+	return nil
+}
+func (p *memoryPersistence) Get(k string, v interface{}) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	b, ok := p.values[k]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(b, v)
+}
+func (p *memoryPersistence) SetReceiverChecksum(id string, checkSum metadata.CheckSum) error {
+	p.Lock()
+	defer p.Unlock()
+	p.checksums[id] = checkSum
+	return nil
+}
+func (p *memoryPersistence) SetTemporaryChecksum(id string, checkSum []byte) error {
+	p.Lock()
+	defer p.Unlock()
+	p.tmp[id] = checkSum
+	return nil
+}
+func (p *memoryPersistence) GetTemporaryChecksum(id string) ([]byte, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.tmp[id], nil
+}
+func (p *memoryPersistence) GetTusdInfo(id string) (*tusd.FileInfo, bool) {
+	p.Lock()
+	defer p.Unlock()
+	info, ok := p.infos[id]
+	return &info, ok
+}
+func (p *memoryPersistence) GetTusdInfos(ids []string) ([]*tusd.FileInfo, error) {
+	var infos []*tusd.FileInfo
+	for _, id := range ids {
+		if info, ok := p.GetTusdInfo(id); ok {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+func (p *memoryPersistence) SetInfo(info tusd.FileInfo) error {
+	p.Lock()
+	defer p.Unlock()
+	p.infos[info.ID] = info
+	return nil
+}
+func (p *memoryPersistence) SetUploadOffset(id string, offset int64) error {
+	p.Lock()
+	defer p.Unlock()
+	info := p.infos[id]
+	info.Offset = offset
+	p.infos[id] = info
+	return nil
+}
+func (p *memoryPersistence) SetUploaded(info tusd.FileInfo) error {
+	return p.SetInfo(info)
+}
+func (p *memoryPersistence) SetConnectorProgress(id string, written int64) error {
+	return nil
+}
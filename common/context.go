@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/indicosystems/proxy-common/metadata"
+)
+
+type contextKey int
+
+const (
+	authenticationPayloadKey contextKey = iota
+	reqIdKey
+	clientIdKey
+	verifiedIdentityKey
+	localizerKey
+)
+
+// The headers read by ContextMiddleware.
+type ContextHeaders struct {
+	ClientId string
+	ApiKey   string
+	UserName string
+	UserId   string
+	UserSid  string
+	ReqId    string
+}
+
+var DefaultContextHeaders = ContextHeaders{
+	ClientId: "Client-Id",
+	ApiKey:   "Api-Key",
+	UserName: "As-User-Name",
+	UserId:   "As-User-Id",
+	UserSid:  "As-User-Sid",
+	ReqId:    "X-Request-Id",
+}
+
+func ContextWithAuthenticationPayload(ctx context.Context, a AuthenticationPayload) context.Context {
+	ctx = context.WithValue(ctx, authenticationPayloadKey, a)
+	if a.ClientId != "" {
+		ctx = ContextWithClientId(ctx, a.ClientId)
+	}
+	return ctx
+}
+
+func AuthenticationPayloadFromContext(ctx context.Context) (AuthenticationPayload, bool) {
+	a, ok := ctx.Value(authenticationPayloadKey).(AuthenticationPayload)
+	return a, ok
+}
+
+// The identity verified by authentication, as stored on the context by AuthenticationMiddleware or
+// JWTAuthenticator.Middleware. Unlike the AuthenticationPayload, it never holds as-user-fields sent by the client,
+// only fields that were proven by the credentials.
+type VerifiedIdentity struct {
+	ClientId string
+	UserName string
+	UserId   string
+	UserSid  string
+}
+
+func ContextWithVerifiedIdentity(ctx context.Context, id VerifiedIdentity) context.Context {
+	return context.WithValue(ctx, verifiedIdentityKey, id)
+}
+
+func VerifiedIdentityFromContext(ctx context.Context) (VerifiedIdentity, bool) {
+	id, ok := ctx.Value(verifiedIdentityKey).(VerifiedIdentity)
+	return id, ok
+}
+
+func ContextWithReqId(ctx context.Context, reqId string) context.Context {
+	return context.WithValue(ctx, reqIdKey, reqId)
+}
+
+func ReqIdFromContext(ctx context.Context) string {
+	s, _ := ctx.Value(reqIdKey).(string)
+	return s
+}
+
+func ContextWithClientId(ctx context.Context, clientId string) context.Context {
+	return context.WithValue(ctx, clientIdKey, clientId)
+}
+
+func ClientIdFromContext(ctx context.Context) string {
+	s, _ := ctx.Value(clientIdKey).(string)
+	return s
+}
+
+// Writes the client-id, as-user-fields and req-id from the context onto the metadata.
+func SetContextOnMetadata(ctx context.Context, m *metadata.Metadata) *metadata.Metadata {
+	if reqId := ReqIdFromContext(ctx); reqId != "" {
+		m.SetReqId(reqId)
+	}
+	if clientId := ClientIdFromContext(ctx); clientId != "" {
+		m.SetClientId(clientId)
+	}
+	a, ok := AuthenticationPayloadFromContext(ctx)
+	if !ok {
+		return m
+	}
+	if a.UserName != "" {
+		m.SetAsUserName(a.UserName)
+	}
+	if a.UserSid != "" {
+		m.SetAsActiveDirectoryUserSid(a.UserSid)
+	}
+	if a.UserId != "" {
+		m.SetAsUserId(a.UserId)
+	}
+	return m
+}
+
+// Reads the AuthenticationPayload from the request-headers
+func (h ContextHeaders) AuthenticationPayload(r *http.Request) AuthenticationPayload {
+	return AuthenticationPayload{
+		ClientId: r.Header.Get(h.ClientId),
+		ApiKey:   r.Header.Get(h.ApiKey),
+		UserName: r.Header.Get(h.UserName),
+		UserId:   r.Header.Get(h.UserId),
+		UserSid:  r.Header.Get(h.UserSid),
+	}
+}
+
+// Middleware that fills the request-context from the headers.
+// A request-id is generated if the client did not provide one, and is returned in the response.
+// A Localizer for the Accept-Language is stored from DefaultCatalog, unless LocalizerMiddleware already stored one.
+func ContextMiddleware(h ContextHeaders, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqId := r.Header.Get(h.ReqId)
+		if reqId == "" {
+			reqId = newReqId()
+		}
+		w.Header().Set(h.ReqId, reqId)
+		ctx := ContextWithReqId(r.Context(), reqId)
+		ctx = ContextWithAuthenticationPayload(ctx, h.AuthenticationPayload(r))
+		if _, ok := ctx.Value(localizerKey).(Localizer); !ok {
+			ctx = ContextWithLocalizer(ctx, DefaultCatalog().LocalizerForRequest(r))
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newReqId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextMiddleware(t *testing.T) {
+	var m metadata.Metadata
+	h := ContextMiddleware(DefaultContextHeaders, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m = metadata.Metadata{}
+		SetContextOnMetadata(r.Context(), &m)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/create", nil)
+	r.Header.Set("Client-Id", "watch-folder")
+	r.Header.Set("As-User-Name", "jane")
+	r.Header.Set("As-User-Sid", "S-1-5-21-1001")
+	r.Header.Set("X-Request-Id", "abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, "abc", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, metadata.Metadata{
+		metadata.ClientId:                 "watch-folder",
+		metadata.AsUserName:               "jane",
+		metadata.AsUserActiveDirectorySid: "S-1-5-21-1001",
+		metadata.ReqId:                    "abc",
+	}, m)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/create", nil))
+	assert.Len(t, w.Header().Get("X-Request-Id"), 32)
+	assert.Equal(t, w.Header().Get("X-Request-Id"), m.GetReqId())
+}
+
+func TestContextMiddleware_Localizer(t *testing.T) {
+	var locale string
+	h := ContextMiddleware(DefaultContextHeaders, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale = LocalizerFromContext(r.Context()).Locale
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/create", nil)
+	r.Header.Set("Accept-Language", "nb-NO, en;q=0.5")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "nb-no", locale)
+
+	c := NewCatalog("de")
+	LocalizerMiddleware(c, h).ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "de", locale, "the localizer of the connector is kept")
+}
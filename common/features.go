@@ -0,0 +1,225 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// The version of the feature-document. Bumped when fields are added to ConnectorFeatures.
+const FeaturesVersion = 2
+
+var (
+	ErrInvalidFeatures     = errors.New("invalid connector-features")
+	ErrFileTooLarge        = errors.New("the file is too large")
+	ErrMimeTypeNotAccepted = errors.New("the file-type is not accepted")
+)
+
+// The features of a connector, as served to clients.
+type FeatureDocument struct {
+	Version int
+	ConnectorFeatures
+}
+
+// Returns the features announced by the connector, or the zero-value if it does not implement FeatureAnnouncer.
+func AnnouncedFeatures(connector interface{}) ConnectorFeatures {
+	if a, ok := connector.(FeatureAnnouncer); ok {
+		return a.AnnounceFeatures()
+	}
+	return ConnectorFeatures{}
+}
+
+// Returns the feature-document for the connector, with defaults filled in.
+// MetadataUpdates is set if the connector implements UploadMetadataUpdater.
+func NewFeatureDocument(connector interface{}) (FeatureDocument, error) {
+	f := AnnouncedFeatures(connector)
+	if err := f.Validate(); err != nil {
+		return FeatureDocument{}, err
+	}
+	if f.Results == "" {
+		f.Results = ResultsSync
+	}
+	if _, ok := connector.(UploadMetadataUpdater); ok {
+		f.MetadataUpdates = true
+	}
+	return FeatureDocument{Version: FeaturesVersion, ConnectorFeatures: f}, nil
+}
+
+// Returns ErrInvalidFeatures if the features contradict themselves, or announce unsupported checksum-algorithms.
+func (f ConnectorFeatures) Validate() error {
+	if f.MinChunkSize > 0 && f.MaxChunkSize > 0 && f.MinChunkSize > f.MaxChunkSize {
+		return fmt.Errorf("%w: MinChunkSize %d is above MaxChunkSize %d", ErrInvalidFeatures, f.MinChunkSize, f.MaxChunkSize)
+	}
+	if f.MaxFileSize < 0 {
+		return fmt.Errorf("%w: MaxFileSize cannot be negative", ErrInvalidFeatures)
+	}
+	for _, kind := range f.ChecksumAlgorithms {
+		if !ChecksumSupported(kind) {
+			return fmt.Errorf("%w: unsupported checksum-algorithm '%s'", ErrInvalidFeatures, kind)
+		}
+	}
+	switch f.Results {
+	case "", ResultsSync, ResultsAsync:
+	default:
+		return fmt.Errorf("%w: unknown result-delivery '%s'", ErrInvalidFeatures, f.Results)
+	}
+	return nil
+}
+
+// Reports whether the mime-type is accepted. Entries like 'video/*' accept all subtypes.
+func (f ConnectorFeatures) AcceptsMimeType(mime string) bool {
+	if len(f.MimeTypes) == 0 {
+		return true
+	}
+	mime = NormalizeMime(mime)
+	for _, accepted := range f.MimeTypes {
+		accepted = NormalizeMime(accepted)
+		if accepted == mime || accepted == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mime, strings.TrimSuffix(accepted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned when an upload violates the features of the connector.
+// Implements tusd.HTTPError, so that it is returned to the client with a fitting status-code.
+type FeatureError struct {
+	err    error
+	status int
+}
+
+func (e *FeatureError) Error() string {
+	return e.err.Error()
+}
+
+func (e *FeatureError) Unwrap() error {
+	return e.err
+}
+
+func (e *FeatureError) StatusCode() int {
+	return e.status
+}
+
+func (e *FeatureError) Body() []byte {
+	return []byte(e.Error())
+}
+
+// Checks the upload against the features. If size is below zero, the fileSize of the metadata is used.
+// Returns a *FeatureError wrapping ErrFileTooLarge or ErrMimeTypeNotAccepted if the upload is not allowed.
+// The size of an upload with a deferred length is unknown here, so FileSizeMiddleware checks it as it grows.
+func (f ConnectorFeatures) CheckUpload(size int64, data *metadata.Metadata) error {
+	um := data.GetUploadMetadata()
+	if size < 0 {
+		size = um.FileSize
+	}
+	if f.MaxFileSize > 0 && size > f.MaxFileSize {
+		return f.fileTooLarge(size)
+	}
+	if um.FileType != "" && !f.AcceptsMimeType(um.FileType) {
+		return &FeatureError{fmt.Errorf("%w: '%s', accepted types are %s", ErrMimeTypeNotAccepted, um.FileType, strings.Join(f.MimeTypes, ", ")), http.StatusUnsupportedMediaType}
+	}
+	if len(f.MimeTypes) > 0 && um.FileType == "" {
+		return &FeatureError{fmt.Errorf("%w: the file-type is required", ErrMimeTypeNotAccepted), http.StatusUnsupportedMediaType}
+	}
+	return nil
+}
+
+func (f ConnectorFeatures) fileTooLarge(size int64) error {
+	return &FeatureError{fmt.Errorf("%w: %d bytes, the maximum is %d bytes", ErrFileTooLarge, size, f.MaxFileSize), http.StatusRequestEntityTooLarge}
+}
+
+// Checks a chunk of length bytes at the offset against MaxFileSize. The uploadLength is the length declared
+// for the upload, or below zero if it is deferred.
+// Returns a *FeatureError wrapping ErrFileTooLarge if the upload would exceed it.
+func (f ConnectorFeatures) CheckChunk(offset, length, uploadLength int64) error {
+	if f.MaxFileSize <= 0 {
+		return nil
+	}
+	if uploadLength > f.MaxFileSize {
+		return f.fileTooLarge(uploadLength)
+	}
+	if offset+length > f.MaxFileSize {
+		return f.fileTooLarge(offset + length)
+	}
+	return nil
+}
+
+// Rejects PATCH-requests that would make the upload exceed MaxFileSize, before they reach tusd.
+//
+// PreUploadCreate cannot check uploads with a deferred length, so they are checked as they grow, and when the
+// length is declared with Upload-Length. Bodies without a Content-Length fail once they exceed the maximum.
+func (f ConnectorFeatures) FileSizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || f.MaxFileSize <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			// Left to tusd to reject
+			next.ServeHTTP(w, r)
+			return
+		}
+		uploadLength := int64(-1)
+		if size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64); err == nil {
+			uploadLength = size
+		}
+		length := r.ContentLength
+		if length < 0 {
+			length = 0
+			r.Body = &limitedBody{r: r.Body, remaining: f.MaxFileSize - offset, exceeded: f.fileTooLarge(f.MaxFileSize + 1)}
+		}
+		if err := f.CheckChunk(offset, length, uploadLength); err != nil {
+			writeTusError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Can be used as tusd's PreUploadCreateCallback, to reject uploads before they are created.
+func (f ConnectorFeatures) PreUploadCreate(hook tusd.HookEvent) error {
+	data := metadata.Metadata(hook.Upload.MetaData)
+	size := int64(-1)
+	if !hook.Upload.SizeIsDeferred {
+		size = hook.Upload.Size
+	}
+	return f.CheckUpload(size, &data)
+}
+
+// NewUploadInitiator that rejects uploads violating the features, before they reach the connector.
+type FeatureCheckedUploadInitiator struct {
+	NewUploadInitiator
+	Features ConnectorFeatures
+}
+
+func (u FeatureCheckedUploadInitiator) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	if err := u.Features.CheckUpload(-1, data); err != nil {
+		return err
+	}
+	return u.NewUploadInitiator.InitiateNewUpload(ctx, data)
+}
+
+// Serves the feature-document of the connector as JSON.
+func FeaturesHandler(connector interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, err := NewFeatureDocument(connector)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(doc)
+	})
+}
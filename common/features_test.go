@@ -0,0 +1,156 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+type announcingConnector struct {
+	features  ConnectorFeatures
+	initiated int
+}
+
+func (c *announcingConnector) AnnounceFeatures() ConnectorFeatures {
+	return c.features
+}
+func (c *announcingConnector) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	c.initiated++
+	return nil
+}
+
+func TestConnectorFeaturesValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		features ConnectorFeatures
+		wantErr  bool
+	}{
+		{"empty", ConnectorFeatures{}, false},
+		{"full", ConnectorFeatures{MinChunkSize: 1, MaxChunkSize: 10, MaxFileSize: 100, ChecksumAlgorithms: []string{"sha256"}, Results: ResultsAsync}, false},
+		{"single chunk", ConnectorFeatures{MinChunkSize: -1, MaxChunkSize: 10}, false},
+		{"chunk-sizes", ConnectorFeatures{MinChunkSize: 11, MaxChunkSize: 10}, true},
+		{"negative file-size", ConnectorFeatures{MaxFileSize: -1}, true},
+		{"unknown checksum", ConnectorFeatures{ChecksumAlgorithms: []string{"crc32"}}, true},
+		{"unknown results", ConnectorFeatures{Results: "later"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.features.Validate()
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidFeatures))
+			}
+		})
+	}
+}
+
+func TestConnectorFeaturesCheckUpload(t *testing.T) {
+	f := ConnectorFeatures{MaxFileSize: 1000, MimeTypes: []string{"video/*", "image/jpg"}}
+	tests := []struct {
+		name       string
+		um         metadata.UploadMetadata
+		size       int64
+		wantErr    error
+		wantStatus int
+	}{
+		{"accepted", metadata.UploadMetadata{FileType: "video/mp4", FileSize: 1000}, -1, nil, 0},
+		{"wildcard", metadata.UploadMetadata{FileType: "video/quicktime"}, 10, nil, 0},
+		{"alias", metadata.UploadMetadata{FileType: "image/jpeg"}, 10, nil, 0},
+		{"too large", metadata.UploadMetadata{FileType: "video/mp4", FileSize: 1001}, -1, ErrFileTooLarge, http.StatusRequestEntityTooLarge},
+		{"upload-length", metadata.UploadMetadata{FileType: "video/mp4", FileSize: 10}, 1001, ErrFileTooLarge, http.StatusRequestEntityTooLarge},
+		{"forbidden type", metadata.UploadMetadata{FileType: "application/pdf"}, 10, ErrMimeTypeNotAccepted, http.StatusUnsupportedMediaType},
+		{"missing type", metadata.UploadMetadata{}, 10, ErrMimeTypeNotAccepted, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.um.ConvertToMetaData()
+			err := f.CheckUpload(tt.size, &data)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, tt.wantErr), err)
+			var httpErr tusd.HTTPError
+			assert.True(t, errors.As(err, &httpErr))
+			assert.Equal(t, tt.wantStatus, httpErr.StatusCode())
+		})
+	}
+
+	um := metadata.UploadMetadata{FileType: "video/mp4"}
+	err := f.PreUploadCreate(tusd.HookEvent{Upload: tusd.FileInfo{Size: 2000, MetaData: tusd.MetaData(um.ConvertToMetaData())}})
+	assert.True(t, errors.Is(err, ErrFileTooLarge))
+}
+
+func TestFeatureCheckedUploadInitiator(t *testing.T) {
+	c := &announcingConnector{features: ConnectorFeatures{MaxFileSize: 10}}
+	u := FeatureCheckedUploadInitiator{c, c.AnnounceFeatures()}
+	small := metadata.UploadMetadata{FileSize: 10}.ConvertToMetaData()
+	large := metadata.UploadMetadata{FileSize: 11}.ConvertToMetaData()
+	assert.NoError(t, u.InitiateNewUpload(context.Background(), &small))
+	assert.True(t, errors.Is(u.InitiateNewUpload(context.Background(), &large), ErrFileTooLarge))
+	assert.Equal(t, 1, c.initiated)
+}
+
+func TestFeaturesHandler(t *testing.T) {
+	c := &announcingConnector{features: ConnectorFeatures{MinChunkSize: 5, MaxFileSize: 100, Deletion: true}}
+	w := httptest.NewRecorder()
+	FeaturesHandler(c).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var doc FeatureDocument
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, FeaturesVersion, doc.Version)
+	assert.Equal(t, int64(100), doc.MaxFileSize)
+	assert.Equal(t, ResultsSync, doc.Results)
+	assert.True(t, doc.Deletion)
+
+	c.features.MinChunkSize, c.features.MaxChunkSize = 10, 5
+	w = httptest.NewRecorder()
+	FeaturesHandler(c).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	doc, err := NewFeatureDocument(struct{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, FeaturesVersion, doc.Version)
+}
+
+func TestConnectorFeaturesFileSizeMiddleware(t *testing.T) {
+	f := ConnectorFeatures{MaxFileSize: 100}
+	h := f.FileSizeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			writeTusError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	patch := func(offset string, body string, chunked bool, uploadLength string) int {
+		var b io.Reader = strings.NewReader(body)
+		if chunked {
+			// Hides the length from httptest
+			b = io.MultiReader(b)
+		}
+		r := httptest.NewRequest(http.MethodPatch, "/files/abc", b)
+		r.Header.Set("Upload-Offset", offset)
+		if uploadLength != "" {
+			r.Header.Set("Upload-Length", uploadLength)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNoContent, patch("0", strings.Repeat("a", 100), false, ""))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, patch("90", strings.Repeat("a", 11), false, ""), "a deferred upload growing beyond the maximum")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, patch("0", "a", false, "101"), "a declared length above the maximum")
+	assert.Equal(t, http.StatusNoContent, patch("90", strings.Repeat("a", 10), true, ""))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, patch("90", strings.Repeat("a", 11), true, ""), "a body without Content-Length")
+	assert.Equal(t, http.StatusNoContent, patch("invalid", "a", false, ""), "left to tusd")
+}
@@ -0,0 +1,361 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAllSearchesFailed = errors.New("the search failed in all connectors")
+)
+
+// SearchHandler searching multiple connectors concurrently, and merging their results.
+//
+// Items are interleaved across connectors, and tagged with the ConnectorId they were found in.
+// Connectors that fail or time out are reported in SearchResult.Errors, and only if all connectors fail
+// is an error returned.
+type FederatedSearchHandler struct {
+	// The maximum time to wait for each connector
+	Timeout  time.Duration
+	mu       sync.RWMutex
+	handlers map[string]SearchHandler
+}
+
+func NewFederatedSearchHandler(timeout time.Duration) *FederatedSearchHandler {
+	return &FederatedSearchHandler{
+		Timeout:  timeout,
+		handlers: map[string]SearchHandler{},
+	}
+}
+
+// Registers the connector, if it implements SearchHandler. Returns false if it does not.
+func (f *FederatedSearchHandler) Register(connectorId string, connector interface{}) bool {
+	h, ok := connector.(SearchHandler)
+	if !ok {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[connectorId] = h
+	return true
+}
+
+// Returns the registered connectors that support the kind, sorted by id.
+func (f *FederatedSearchHandler) connectors(kind SearchKind) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var ids []string
+	for id, h := range f.handlers {
+		if kind != "" {
+			if supported, _ := h.SearchableFields(); !supported.IsEnabled(kind) {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *FederatedSearchHandler) handler(connectorId string) SearchHandler {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.handlers[connectorId]
+}
+
+type federatedResult struct {
+	connectorId string
+	result      SearchResult
+	err         error
+}
+
+// The position of a connector in a federated search, as stored in the merged NextCursor.
+type federatedPosition struct {
+	Offset int    `json:"o,omitempty"`
+	Cursor string `json:"c,omitempty"`
+	// The number of items at the start of the page that were returned on a previous page
+	Skip int `json:"s,omitempty"`
+}
+
+// The positions of the connectors, by ConnectorId. Connectors that are not present have no more results.
+type federatedCursor map[string]federatedPosition
+
+func (c federatedCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeFederatedCursor(s string) (federatedCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidSearch)
+	}
+	var c federatedCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidSearch)
+	}
+	return c, nil
+}
+
+// Searches every connector supporting the kind, each from its own position.
+//
+// The NextCursor of the merged aggregates holds the position of every connector, so that items left out due to
+// the limit are returned on the next page. A Cursor is never passed on as is; each connector receives its own.
+// An Offset is rejected with ErrUnsupportedSearch, as it cannot be split across connectors; page with the cursor.
+// Connectors that fail or time out are reported in the Errors of the page, and are left out of later pages.
+//
+// Connectors implementing ContextSearchHandler have their context cancelled when they time out.
+// Others are left to finish in the background.
+func (f *FederatedSearchHandler) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	return f.SearchContext(context.Background(), a, in)
+}
+
+func (f *FederatedSearchHandler) SearchContext(ctx context.Context, a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	if in.Offset != 0 {
+		return SearchResult{}, fmt.Errorf("%w: federated searches are paged by cursor, not by offset", ErrUnsupportedSearch)
+	}
+	ids := f.connectors(in.Kind)
+	positions := map[string]federatedPosition{}
+	if in.Cursor != "" {
+		cursor, err := decodeFederatedCursor(in.Cursor)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		var remaining []string
+		for _, id := range ids {
+			if p, ok := cursor[id]; ok {
+				positions[id] = p
+				remaining = append(remaining, id)
+			}
+		}
+		ids = remaining
+	}
+	if len(ids) == 0 {
+		return SearchResult{}, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if f.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+	}
+	defer cancel()
+
+	results := make(chan federatedResult, len(ids))
+	for _, id := range ids {
+		p := positions[id]
+		cin := in
+		cin.Offset, cin.Cursor = p.Offset, p.Cursor
+		if cin.Limit > 0 {
+			cin.Limit += p.Skip
+		}
+		go func(id string, h SearchHandler, in SearchInput) {
+			res, err := searchContext(ctx, h, a, in)
+			results <- federatedResult{id, res, err}
+		}(id, f.handler(id), cin)
+	}
+
+	collected := map[string]federatedResult{}
+collect:
+	for range ids {
+		select {
+		case r := <-results:
+			collected[r.connectorId] = r
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	var (
+		merged SearchResult
+		ok     []federatedResult
+	)
+	for _, id := range ids {
+		r, found := collected[id]
+		switch {
+		case !found:
+			merged.Errors = append(merged.Errors, SearchError{ConnectorId: id, Message: fmt.Sprintf("timed out after %s", f.Timeout)})
+		case r.err != nil:
+			merged.Errors = append(merged.Errors, SearchError{ConnectorId: id, Message: r.err.Error()})
+		default:
+			ok = append(ok, r)
+			merged.Errors = append(merged.Errors, r.result.Errors...)
+		}
+	}
+	if len(ok) == 0 {
+		return merged, ErrAllSearchesFailed
+	}
+	pick := func(get func(SearchResult) *SearchAggregate) *SearchAggregate {
+		var aggs []federatedAggregate
+		for _, r := range ok {
+			_, options := f.handler(r.connectorId).SearchableFields()
+			fa := federatedAggregate{connectorId: r.connectorId, position: positions[r.connectorId], cursors: options.SupportsCursor}
+			if agg := get(r.result); agg != nil {
+				fa.total = len(agg.Items)
+				fa.agg = tagSearchAggregate(r.connectorId, agg, fa.position.Skip)
+			}
+			aggs = append(aggs, fa)
+		}
+		return mergeSearchAggregates(aggs, in)
+	}
+	merged.User = pick(func(r SearchResult) *SearchAggregate { return r.User })
+	merged.Parent = pick(func(r SearchResult) *SearchAggregate { return r.Parent })
+	merged.Case = pick(func(r SearchResult) *SearchAggregate { return r.Case })
+	merged.Group = pick(func(r SearchResult) *SearchAggregate { return r.Group })
+	return merged, nil
+}
+
+// Returns a copy of the aggregate without the first skip items, with every item tagged with the connector.
+func tagSearchAggregate(connectorId string, agg *SearchAggregate, skip int) *SearchAggregate {
+	if skip > len(agg.Items) {
+		skip = len(agg.Items)
+	}
+	c := *agg
+	c.Items = make([]SearchResultItem, 0, len(agg.Items)-skip)
+	for _, item := range agg.Items[skip:] {
+		item.ConnectorId = connectorId
+		c.Items = append(c.Items, item)
+	}
+	return &c
+}
+
+// The aggregate of a single connector, and the position it was searched from.
+type federatedAggregate struct {
+	connectorId string
+	// Nil if the connector did not return the aggregate
+	agg *SearchAggregate
+	// The number of items returned by the connector, including the skipped ones
+	total    int
+	position federatedPosition
+	// Whether the connector supports cursors
+	cursors bool
+}
+
+// Returns the position to continue from after consumed items of the aggregate were returned,
+// or false if the connector has no more results.
+func (a federatedAggregate) next(consumed int) (federatedPosition, bool) {
+	p := a.position
+	if used := p.Skip + consumed; used < a.total {
+		if a.cursors {
+			return federatedPosition{Offset: p.Offset, Cursor: p.Cursor, Skip: used}, true
+		}
+		return federatedPosition{Offset: p.Offset + used}, true
+	}
+	switch {
+	case a.agg == nil || a.total == 0 || a.agg.HasMore == HasMoreNo:
+		return federatedPosition{}, false
+	case a.agg.NextCursor != "":
+		return federatedPosition{Cursor: a.agg.NextCursor}, true
+	case p.Cursor == "":
+		return federatedPosition{Offset: p.Offset + a.total}, true
+	}
+	return federatedPosition{}, false
+}
+
+// Interleaves the items of the aggregates, up to the limit.
+//
+// HasMore is YES if any connector has more, or if items were left out due to the limit.
+// It is NO only if every connector reported NO. The NextCursor holds the position of every connector with
+// more results.
+func mergeSearchAggregates(aggs []federatedAggregate, in SearchInput) *SearchAggregate {
+	var present []federatedAggregate
+	for _, a := range aggs {
+		if a.agg != nil {
+			present = append(present, a)
+		}
+	}
+	if len(present) == 0 {
+		return nil
+	}
+	merged := &SearchAggregate{HasMore: HasMoreNo}
+	total := 0
+	for _, a := range present {
+		switch a.agg.HasMore {
+		case HasMoreTrue:
+			merged.HasMore = HasMoreTrue
+		case HasMoreUnknown:
+			if merged.HasMore != HasMoreTrue {
+				merged.HasMore = HasMoreUnknown
+			}
+		}
+		total += len(a.agg.Items)
+	}
+	full := func() bool { return in.Limit > 0 && len(merged.Items) >= in.Limit }
+	consumed := make([]int, len(present))
+	for i := 0; len(merged.Items) < total && !full(); i++ {
+		for j, a := range present {
+			if i < len(a.agg.Items) && !full() {
+				merged.Items = append(merged.Items, a.agg.Items[i])
+				consumed[j]++
+			}
+		}
+	}
+	if len(merged.Items) < total {
+		merged.HasMore = HasMoreTrue
+	}
+	next := federatedCursor{}
+	for j, a := range present {
+		if p, ok := a.next(consumed[j]); ok {
+			next[a.connectorId] = p
+		}
+	}
+	if len(next) > 0 {
+		merged.NextCursor = next.encode()
+		if merged.HasMore == HasMoreNo {
+			merged.HasMore = HasMoreUnknown
+		}
+	}
+	return merged
+}
+
+func (f *FederatedSearchHandler) SearchCacheKey(a AuthenticationPayload, in SearchInput) string {
+	var keys []string
+	for _, id := range f.connectors(in.Kind) {
+		key := f.handler(id).SearchCacheKey(a, in)
+		if key == "" {
+			// A connector that cannot be cached makes the whole search uncacheable
+			return ""
+		}
+		keys = append(keys, id+"="+key)
+	}
+	// The connectors are searched from the positions in the cursor, not from the cursor itself
+	return strings.Join(append(keys, "cursor="+in.Cursor), "\x00")
+}
+
+// Returns the union of the searchable fields and sort-fields of all connectors.
+// Authentication is required if any connector requires it. Cursors are always supported, as the merged results are
+// paged by cursor only.
+func (f *FederatedSearchHandler) SearchableFields() (*SupportedSearches, SearchOptions) {
+	supported := &SupportedSearches{}
+	options := SearchOptions{SupportsCursor: true}
+	for _, id := range f.connectors("") {
+		s, o := f.handler(id).SearchableFields()
+		if o.RequiresAuthentication {
+			options.RequiresAuthentication = true
+		}
+		for _, field := range o.SortFields {
+			if !containsSortField(options.SortFields, field) {
+				options.SortFields = append(options.SortFields, field)
+			}
+		}
+		if s == nil {
+			continue
+		}
+		supported.Enable(s.Enabled()...)
+	}
+	return supported, options
+}
+
+func containsSortField(fields []SearchSortField, field SearchSortField) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticSearcher struct {
+	result SearchResult
+	err    error
+	delay  time.Duration
+}
+
+func (s staticSearcher) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	time.Sleep(s.delay)
+	return s.result, s.err
+}
+func (s staticSearcher) SearchCacheKey(a AuthenticationPayload, in SearchInput) string {
+	return in.Query
+}
+func (s staticSearcher) SearchableFields() (*SupportedSearches, SearchOptions) {
+	return &SupportedSearches{CaseName: true}, SearchOptions{}
+}
+
+func TestFederatedSearchHandler(t *testing.T) {
+	f := NewFederatedSearchHandler(100 * time.Millisecond)
+	f.Register("a", staticSearcher{result: SearchResult{Case: &SearchAggregate{HasMore: HasMoreNo, Items: []SearchResultItem{{ID: "a1"}, {ID: "a2"}}}}})
+	f.Register("b", staticSearcher{result: SearchResult{Case: &SearchAggregate{HasMore: HasMoreNo, Items: []SearchResultItem{{ID: "b1"}}}}})
+	f.Register("c", staticSearcher{err: errors.New("unreachable")})
+	f.Register("d", staticSearcher{delay: time.Second})
+
+	res, err := f.Search(AuthenticationPayload{}, SearchInput{Query: "burg", Kind: "CaseName", Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []SearchResultItem{{ID: "a1", ConnectorId: "a"}, {ID: "b1", ConnectorId: "b"}}, res.Case.Items)
+	assert.Equal(t, HasMoreTrue, res.Case.HasMore)
+	assert.Nil(t, res.User)
+	if assert.Len(t, res.Errors, 2) {
+		assert.Equal(t, "c", res.Errors[0].ConnectorId)
+		assert.Equal(t, "d", res.Errors[1].ConnectorId)
+	}
+
+	res, err = f.Search(AuthenticationPayload{}, SearchInput{Query: "burg", Kind: "UserName"})
+	assert.NoError(t, err)
+	assert.Nil(t, res.Case, "connectors not supporting the kind are not searched")
+
+	_, err = f.Search(AuthenticationPayload{}, SearchInput{Query: "burg", Kind: "CaseName", Offset: 2})
+	assert.True(t, errors.Is(err, ErrUnsupportedSearch), "federated searches are paged by cursor")
+
+	f = NewFederatedSearchHandler(time.Second)
+	f.Register("c", staticSearcher{err: errors.New("unreachable")})
+	_, err = f.Search(AuthenticationPayload{}, SearchInput{Query: "burg"})
+	assert.True(t, errors.Is(err, ErrAllSearchesFailed))
+}
+
+// Pages through the items by offset, or by cursor if cursors is set. Records the inputs it receives.
+type pagingSearcher struct {
+	items   []string
+	cursors bool
+	mu      sync.Mutex
+	inputs  []SearchInput
+}
+
+func (s *pagingSearcher) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	s.mu.Lock()
+	s.inputs = append(s.inputs, in)
+	s.mu.Unlock()
+	start := in.Offset
+	if in.Cursor != "" {
+		start, _ = strconv.Atoi(in.Cursor)
+	}
+	end := len(s.items)
+	if in.Limit > 0 && start+in.Limit < end {
+		end = start + in.Limit
+	}
+	agg := &SearchAggregate{Offset: start, HasMore: HasMoreNo}
+	for _, id := range s.items[start:end] {
+		agg.Items = append(agg.Items, SearchResultItem{ID: id})
+	}
+	if end < len(s.items) {
+		agg.HasMore = HasMoreTrue
+		if s.cursors {
+			agg.NextCursor = strconv.Itoa(end)
+		}
+	}
+	return SearchResult{Case: agg}, nil
+}
+func (s *pagingSearcher) SearchCacheKey(a AuthenticationPayload, in SearchInput) string {
+	return in.Query
+}
+func (s *pagingSearcher) SearchableFields() (*SupportedSearches, SearchOptions) {
+	return &SupportedSearches{CaseName: true}, SearchOptions{SupportsCursor: s.cursors, SortFields: []SearchSortField{SortID}}
+}
+
+func TestFederatedSearchHandler_Paging(t *testing.T) {
+	a := &pagingSearcher{items: []string{"a1", "a2", "a3"}}
+	b := &pagingSearcher{items: []string{"b1", "b2", "b3", "b4"}, cursors: true}
+	f := NewFederatedSearchHandler(time.Second)
+	f.Register("a", a)
+	f.Register("b", b)
+
+	var (
+		ids     []string
+		cursor  string
+		cursors []string
+	)
+	for page := 0; page < 10; page++ {
+		res, err := f.Search(AuthenticationPayload{}, SearchInput{Query: "burg", Limit: 3, Cursor: cursor})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, len(res.Case.Items), 3)
+		for _, item := range res.Case.Items {
+			ids = append(ids, item.ID)
+		}
+		cursor = res.Case.NextCursor
+		cursors = append(cursors, cursor)
+		if cursor == "" {
+			assert.Equal(t, HasMoreNo, res.Case.HasMore)
+			break
+		}
+	}
+	assert.ElementsMatch(t, []string{"a1", "a2", "a3", "b1", "b2", "b3", "b4"}, ids, "items left out on a page are returned on the next")
+	assert.Len(t, ids, 7)
+
+	for _, in := range a.inputs {
+		assert.Equal(t, "", in.Cursor, "the merged cursor is not passed on to connectors")
+	}
+	// Only b1 of the first page of b is returned. The second page asks for the same page, and skips it.
+	assert.Equal(t, SearchInput{Query: "burg", Limit: 3}, b.inputs[0])
+	assert.Equal(t, SearchInput{Query: "burg", Limit: 4}, b.inputs[1])
+
+	_, err := f.Search(AuthenticationPayload{}, SearchInput{Query: "burg", Cursor: "not a cursor"})
+	assert.True(t, errors.Is(err, ErrInvalidSearch))
+	assert.NotEqual(t, f.SearchCacheKey(AuthenticationPayload{}, SearchInput{Query: "burg"}), f.SearchCacheKey(AuthenticationPayload{}, SearchInput{Query: "burg", Cursor: cursors[0]}))
+}
+
+func TestFederatedSearchHandler_SearchableFields(t *testing.T) {
+	f := NewFederatedSearchHandler(time.Second)
+	f.Register("a", staticSearcher{})
+	f.Register("b", &pagingSearcher{})
+	supported, options := f.SearchableFields()
+	assert.Equal(t, []SearchKind{SearchCaseName}, supported.Enabled())
+	assert.True(t, options.SupportsCursor)
+	assert.Equal(t, []SearchSortField{SortID}, options.SortFields)
+}
+
+// Blocks until the context is cancelled.
+type blockingSearcher struct {
+	staticSearcher
+	cancelled chan struct{}
+}
+
+func (s blockingSearcher) SearchContext(ctx context.Context, a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	<-ctx.Done()
+	close(s.cancelled)
+	return SearchResult{}, ctx.Err()
+}
+
+func TestFederatedSearchHandler_Cancel(t *testing.T) {
+	s := blockingSearcher{cancelled: make(chan struct{})}
+	f := NewFederatedSearchHandler(10 * time.Millisecond)
+	f.Register("a", staticSearcher{result: SearchResult{Case: &SearchAggregate{Items: []SearchResultItem{{ID: "a1"}}}}})
+	f.Register("b", s)
+
+	res, err := f.Search(AuthenticationPayload{}, SearchInput{Query: "burg"})
+	assert.NoError(t, err)
+	assert.Len(t, res.Errors, 1)
+	select {
+	case <-s.cancelled:
+	case <-time.After(time.Second):
+		t.Error("the context of the connector that timed out was not cancelled")
+	}
+	cursor, err := decodeFederatedCursor(res.Case.NextCursor)
+	assert.NoError(t, err)
+	assert.Contains(t, cursor, "a")
+	assert.NotContains(t, cursor, "b", "the connector that timed out is left out of later pages")
+}
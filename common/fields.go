@@ -0,0 +1,318 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnsupportedValidation = errors.New("the validation is not supported by the connector")
+)
+
+// The entity a field identifies.
+type FieldEntity string
+
+const (
+	EntityUser   FieldEntity = "User"
+	EntityParent FieldEntity = "Parent"
+	EntityCase   FieldEntity = "Case"
+	EntityGroup  FieldEntity = "Group"
+)
+
+// Describes a field that can be searched and validated.
+//
+// The descriptors are the single source of which fields exist. SupportedSearches, SupportedValidation,
+// ValidatePayload, ValidateResponse and ValidateNullableResponse hold a struct-field for each of them,
+// as that is the shape on the wire, but everything else iterates the descriptors.
+// To add a field, add it to those structs and add a descriptor to FieldDescriptors.
+type FieldDescriptor struct {
+	Kind       SearchKind
+	Entity     FieldEntity
+	search     func(s *SupportedSearches) *bool
+	validation func(s *SupportedValidation) *bool
+	payload    func(p *ValidatePayload) *string
+	// Copies the response for the field from r to n
+	nullable func(r *ValidateResponse, n *ValidateNullableResponse)
+	// Returns the error of the response for the field, if any
+	responseError func(r *ValidateResponse) *ValidationErrorResponse
+}
+
+var FieldDescriptors = []FieldDescriptor{
+	{
+		Kind:          SearchUserID,
+		Entity:        EntityUser,
+		search:        func(s *SupportedSearches) *bool { return &s.UserID },
+		validation:    func(s *SupportedValidation) *bool { return &s.UserID },
+		payload:       func(p *ValidatePayload) *string { return &p.UserID },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.UserID; n.UserID = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.UserID.Error },
+	},
+	{
+		Kind:          SearchUserName,
+		Entity:        EntityUser,
+		search:        func(s *SupportedSearches) *bool { return &s.UserName },
+		validation:    func(s *SupportedValidation) *bool { return &s.UserName },
+		payload:       func(p *ValidatePayload) *string { return &p.UserName },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.UserName; n.UserName = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.UserName.Error },
+	},
+	{
+		Kind:          SearchSid,
+		Entity:        EntityUser,
+		search:        func(s *SupportedSearches) *bool { return &s.Sid },
+		validation:    func(s *SupportedValidation) *bool { return &s.Sid },
+		payload:       func(p *ValidatePayload) *string { return &p.Sid },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.Sid; n.Sid = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.Sid.Error },
+	},
+	{
+		Kind:          SearchParentID,
+		Entity:        EntityParent,
+		search:        func(s *SupportedSearches) *bool { return &s.ParentID },
+		validation:    func(s *SupportedValidation) *bool { return &s.ParentID },
+		payload:       func(p *ValidatePayload) *string { return &p.ParentID },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.ParentID; n.ParentID = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.ParentID.Error },
+	},
+	{
+		Kind:          SearchParentName,
+		Entity:        EntityParent,
+		search:        func(s *SupportedSearches) *bool { return &s.ParentName },
+		validation:    func(s *SupportedValidation) *bool { return &s.ParentName },
+		payload:       func(p *ValidatePayload) *string { return &p.ParentName },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.ParentName; n.ParentName = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.ParentName.Error },
+	},
+	{
+		Kind:          SearchCaseID,
+		Entity:        EntityCase,
+		search:        func(s *SupportedSearches) *bool { return &s.CaseID },
+		validation:    func(s *SupportedValidation) *bool { return &s.CaseID },
+		payload:       func(p *ValidatePayload) *string { return &p.CaseID },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.CaseID; n.CaseID = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.CaseID.Error },
+	},
+	{
+		Kind:          SearchCaseName,
+		Entity:        EntityCase,
+		search:        func(s *SupportedSearches) *bool { return &s.CaseName },
+		validation:    func(s *SupportedValidation) *bool { return &s.CaseName },
+		payload:       func(p *ValidatePayload) *string { return &p.CaseName },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.CaseName; n.CaseName = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.CaseName.Error },
+	},
+	{
+		Kind:          SearchGroupName,
+		Entity:        EntityGroup,
+		search:        func(s *SupportedSearches) *bool { return &s.GroupName },
+		validation:    func(s *SupportedValidation) *bool { return &s.GroupName },
+		payload:       func(p *ValidatePayload) *string { return &p.GroupName },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.GroupName; n.GroupName = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.GroupName.Error },
+	},
+	{
+		Kind:          SearchGroupID,
+		Entity:        EntityGroup,
+		search:        func(s *SupportedSearches) *bool { return &s.GroupID },
+		validation:    func(s *SupportedValidation) *bool { return &s.GroupID },
+		payload:       func(p *ValidatePayload) *string { return &p.GroupID },
+		nullable:      func(r *ValidateResponse, n *ValidateNullableResponse) { v := r.GroupID; n.GroupID = &v },
+		responseError: func(r *ValidateResponse) *ValidationErrorResponse { return r.GroupID.Error },
+	},
+}
+
+// Returns the descriptor for the kind.
+func Field(kind SearchKind) (FieldDescriptor, bool) {
+	for _, d := range FieldDescriptors {
+		if d.Kind == kind {
+			return d, true
+		}
+	}
+	return FieldDescriptor{}, false
+}
+
+func (s *SupportedSearches) IsEnabled(kind SearchKind) bool {
+	d, ok := Field(kind)
+	return ok && s != nil && *d.search(s)
+}
+
+func (s *SupportedSearches) Enable(kinds ...SearchKind) {
+	for _, kind := range kinds {
+		if d, ok := Field(kind); ok {
+			*d.search(s) = true
+		}
+	}
+}
+
+// Returns the enabled kinds, in the order of FieldDescriptors.
+func (s *SupportedSearches) Enabled() []SearchKind {
+	var kinds []SearchKind
+	for _, d := range FieldDescriptors {
+		if s != nil && *d.search(s) {
+			kinds = append(kinds, d.Kind)
+		}
+	}
+	return kinds
+}
+
+func (s *SupportedValidation) IsEnabled(kind SearchKind) bool {
+	d, ok := Field(kind)
+	return ok && s != nil && *d.validation(s)
+}
+
+func (s *SupportedValidation) Enable(kinds ...SearchKind) {
+	for _, kind := range kinds {
+		if d, ok := Field(kind); ok {
+			*d.validation(s) = true
+		}
+	}
+}
+
+// Returns the enabled kinds, in the order of FieldDescriptors.
+func (s *SupportedValidation) Enabled() []SearchKind {
+	var kinds []SearchKind
+	for _, d := range FieldDescriptors {
+		if s != nil && *d.validation(s) {
+			kinds = append(kinds, d.Kind)
+		}
+	}
+	return kinds
+}
+
+func (s *SupportedValidation) MapEnabled() map[string]bool {
+	a := map[string]bool{}
+	for _, kind := range s.Enabled() {
+		a[string(kind)] = true
+	}
+	return a
+}
+
+func (p ValidatePayload) Get(kind SearchKind) string {
+	if d, ok := Field(kind); ok {
+		return *d.payload(&p)
+	}
+	return ""
+}
+
+func (p *ValidatePayload) Set(kind SearchKind, value string) {
+	if d, ok := Field(kind); ok {
+		*d.payload(p) = value
+	}
+}
+
+// Returns the kinds that have a value in the payload, in the order of FieldDescriptors.
+func (p ValidatePayload) Fields() []SearchKind {
+	var kinds []SearchKind
+	for _, d := range FieldDescriptors {
+		if *d.payload(&p) != "" {
+			kinds = append(kinds, d.Kind)
+		}
+	}
+	return kinds
+}
+
+// Returns the response as a ValidateNullableResponse, holding only the fields that were set in the payload.
+func (r ValidateResponse) Nullable(p ValidatePayload) ValidateNullableResponse {
+	var n ValidateNullableResponse
+	r.copyNullable(p, &n)
+	return n
+}
+
+// Returns true if the response for any of the fields set in the payload holds an error.
+func (r ValidateResponse) HasErrors(p ValidatePayload) bool {
+	for _, d := range FieldDescriptors {
+		if *d.payload(&p) != "" && d.responseError(&r) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ValidateResponse) copyNullable(p ValidatePayload, n *ValidateNullableResponse) {
+	for _, d := range FieldDescriptors {
+		if *d.payload(&p) != "" {
+			d.nullable(&r, n)
+		}
+	}
+}
+
+// Can be implemented by a Validator to announce which fields it validates.
+type ValidationAnnouncer interface {
+	ValidatableFields() *SupportedValidation
+}
+
+// Returns ErrUnsupportedValidation if the payload holds fields that are not supported.
+func CheckValidatePayload(supported *SupportedValidation, p ValidatePayload) error {
+	var unsupported []string
+	for _, kind := range p.Fields() {
+		if !supported.IsEnabled(kind) {
+			unsupported = append(unsupported, string(kind))
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedValidation, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// Validator that rejects payloads with fields the connector does not support, if it implements ValidationAnnouncer.
+type CheckedValidator struct {
+	Validator
+}
+
+func (v CheckedValidator) Validate(r *http.Request, a AuthenticationPayload, p ValidatePayload) (ValidateResponse, error) {
+	if announcer, ok := v.Validator.(ValidationAnnouncer); ok {
+		if err := CheckValidatePayload(announcer.ValidatableFields(), p); err != nil {
+			return ValidateResponse{}, err
+		}
+	}
+	return v.Validator.Validate(r, a, p)
+}
+
+// What a connector supports for a field, as advertised to clients.
+type FieldCapability struct {
+	Kind     SearchKind
+	Entity   FieldEntity
+	Search   bool `json:",omitempty"`
+	Validate bool `json:",omitempty"`
+}
+
+// Returns the capabilities of the connector for each field it supports, in the order of FieldDescriptors.
+func FieldCapabilities(connector interface{}) []FieldCapability {
+	var (
+		search     *SupportedSearches
+		validation *SupportedValidation
+	)
+	if h, ok := connector.(SearchHandler); ok {
+		search, _ = h.SearchableFields()
+	}
+	if v, ok := connector.(ValidationAnnouncer); ok {
+		validation = v.ValidatableFields()
+	}
+	var caps []FieldCapability
+	for _, d := range FieldDescriptors {
+		c := FieldCapability{
+			Kind:     d.Kind,
+			Entity:   d.Entity,
+			Search:   search.IsEnabled(d.Kind),
+			Validate: validation.IsEnabled(d.Kind),
+		}
+		if c.Search || c.Validate {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// Responds to OPTIONS-requests with the FieldCapabilities of the connector as JSON.
+func FieldOptionsHandler(connector interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "OPTIONS, GET, POST")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(FieldCapabilities(connector))
+	})
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Guards against structs and descriptors drifting apart
+func TestFieldDescriptorsCoverStructs(t *testing.T) {
+	for _, v := range []interface{}{SupportedSearches{}, SupportedValidation{}, ValidatePayload{}, ValidateResponse{}, ValidateNullableResponse{}} {
+		typ := reflect.TypeOf(v)
+		var names []SearchKind
+		for i := 0; i < typ.NumField(); i++ {
+			if name := typ.Field(i).Name; name != "Error" {
+				names = append(names, SearchKind(name))
+			}
+		}
+		var kinds []SearchKind
+		for _, d := range FieldDescriptors {
+			kinds = append(kinds, d.Kind)
+		}
+		assert.Equal(t, kinds, names, typ.Name())
+	}
+	// Every descriptor must access its own struct-field
+	for _, d := range FieldDescriptors {
+		var (
+			s SupportedSearches
+			v SupportedValidation
+			p ValidatePayload
+			r ValidateResponse
+			n ValidateNullableResponse
+		)
+		*d.search(&s) = true
+		*d.validation(&v) = true
+		*d.payload(&p) = "x"
+		reflect.ValueOf(&r).Elem().FieldByName(string(d.Kind)).FieldByName("Error").Set(reflect.ValueOf(&ValidationErrorResponse{}))
+		d.nullable(&r, &n)
+		assert.Equal(t, []SearchKind{d.Kind}, s.Enabled(), string(d.Kind))
+		assert.Equal(t, []SearchKind{d.Kind}, v.Enabled(), string(d.Kind))
+		assert.Equal(t, []SearchKind{d.Kind}, p.Fields(), string(d.Kind))
+		assert.NotNil(t, d.responseError(&r), string(d.Kind))
+		assert.False(t, reflect.ValueOf(n).FieldByName(string(d.Kind)).IsNil(), string(d.Kind))
+	}
+}
+
+func TestSupportedFields(t *testing.T) {
+	s := &SupportedSearches{ParentID: true}
+	s.Enable(SearchCaseName)
+	assert.Equal(t, map[string]bool{"ParentID": true, "CaseName": true}, s.MapEnabled())
+	assert.True(t, s.IsEnabled(SearchParentID))
+	assert.False(t, s.IsEnabled(SearchCaseID))
+	assert.False(t, (*SupportedSearches)(nil).IsEnabled(SearchCaseID))
+
+	v := &SupportedValidation{}
+	v.Enable(SearchUserName, SearchGroupID)
+	assert.Equal(t, []SearchKind{SearchUserName, SearchGroupID}, v.Enabled())
+	assert.Equal(t, map[string]bool{"UserName": true, "GroupID": true}, v.MapEnabled())
+}
+
+func TestValidatePayloadFields(t *testing.T) {
+	var p ValidatePayload
+	p.Set(SearchCaseID, "C6288")
+	p.Set(SearchUserName, "jane")
+	assert.Equal(t, "C6288", p.CaseID)
+	assert.Equal(t, "jane", p.Get(SearchUserName))
+	assert.Equal(t, []SearchKind{SearchUserName, SearchCaseID}, p.Fields())
+
+	r := ValidateResponse{
+		UserName: ValidateUserResponse{ID: "1"},
+		CaseID:   ValidateCaseResponse{ID: "C6288"},
+		GroupID:  ValidateGroupResponse{ID: "unrequested"},
+	}
+	n := r.Nullable(p)
+	assert.Equal(t, "1", n.UserName.ID)
+	assert.Equal(t, "C6288", n.CaseID.ID)
+	assert.Nil(t, n.GroupID)
+	assert.Nil(t, n.UserID)
+
+	assert.NoError(t, CheckValidatePayload(&SupportedValidation{UserName: true, CaseID: true}, p))
+	err := CheckValidatePayload(&SupportedValidation{UserName: true}, p)
+	assert.True(t, errors.Is(err, ErrUnsupportedValidation))
+	assert.Contains(t, err.Error(), "CaseID")
+}
+
+type announcingValidator struct{}
+
+func (announcingValidator) Validate(r *http.Request, a AuthenticationPayload, p ValidatePayload) (ValidateResponse, error) {
+	return ValidateResponse{CaseID: ValidateCaseResponse{ID: p.CaseID}}, nil
+}
+func (announcingValidator) ValidatableFields() *SupportedValidation {
+	return &SupportedValidation{CaseID: true}
+}
+func (announcingValidator) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	return SearchResult{}, nil
+}
+func (announcingValidator) SearchCacheKey(a AuthenticationPayload, in SearchInput) string {
+	return in.Key()
+}
+func (announcingValidator) SearchableFields() (*SupportedSearches, SearchOptions) {
+	return &SupportedSearches{CaseID: true, CaseName: true}, SearchOptions{}
+}
+
+func TestCheckedValidator(t *testing.T) {
+	v := CheckedValidator{announcingValidator{}}
+	res, err := v.Validate(nil, AuthenticationPayload{}, ValidatePayload{CaseID: "C6288"})
+	assert.NoError(t, err)
+	assert.Equal(t, "C6288", res.CaseID.ID)
+	_, err = v.Validate(nil, AuthenticationPayload{}, ValidatePayload{GroupID: "g"})
+	assert.True(t, errors.Is(err, ErrUnsupportedValidation))
+}
+
+func TestFieldOptionsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	FieldOptionsHandler(announcingValidator{}).ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var caps []FieldCapability
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &caps))
+	assert.Equal(t, []FieldCapability{
+		{Kind: SearchCaseID, Entity: EntityCase, Search: true, Validate: true},
+		{Kind: SearchCaseName, Entity: EntityCase, Search: true},
+	}, caps)
+}
@@ -0,0 +1,303 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthDegraded HealthStatus = "degraded"
+	HealthDown     HealthStatus = "down"
+)
+
+// Commonly used names for health-checks.
+const (
+	HealthCheckBackend        = "backend"
+	HealthCheckAuthentication = "authentication"
+	HealthCheckQueue          = "queue"
+)
+
+// The result of a single named check, like backend-reachability.
+type HealthCheck struct {
+	Name    string
+	Status  HealthStatus
+	Latency time.Duration
+	Message string `json:",omitempty"`
+	// The last time this check succeeded. If not set by the reporter, the HealthAggregator will fill it in.
+	LastSuccess *time.Time `json:",omitempty"`
+	// Set if a failure means that the connector is not alive, and must be restarted.
+	// All checks affect readiness.
+	Liveness bool `json:",omitempty"`
+}
+
+type HealthReport struct {
+	Status HealthStatus
+	Checks []HealthCheck
+}
+
+// Can be implemented by connectors to report the health of each of its dependencies.
+// Connectors implementing only HealthReporter are adapted automatically by the HealthAggregator.
+type DetailedHealthReporter interface {
+	GetHealthReport(ctx context.Context) HealthReport
+}
+
+// Combines the status of the checks. Any check that is down will mark the report as down.
+func CombineHealthStatus(checks []HealthCheck) HealthStatus {
+	status := HealthOK
+	for _, c := range checks {
+		switch c.Status {
+		case HealthDown:
+			return HealthDown
+		case HealthDegraded:
+			status = HealthDegraded
+		case HealthOK:
+		default:
+			// Unknown statuses are treated as degraded
+			status = HealthDegraded
+		}
+	}
+	return status
+}
+
+// Runs a function as a HealthCheck, timing it.
+func RunHealthCheck(name string, fn func() error) HealthCheck {
+	start := time.Now()
+	err := fn()
+	c := HealthCheck{
+		Name:    name,
+		Status:  HealthOK,
+		Latency: time.Since(start),
+	}
+	if err != nil {
+		c.Status = HealthDown
+		c.Message = err.Error()
+	}
+	return c
+}
+
+// Reports the number of due items in the queue for the connector.
+// The check is degraded if more than max items are due.
+func QueueBacklogCheck(q QueueStorer, connectorId string, max int) HealthCheck {
+	var count int
+	c := RunHealthCheck(HealthCheckQueue, func() error {
+		qis, _, err := q.GetAll(GetAllOptions{
+			ConnectorId: connectorId,
+			OnlyDue:     true,
+			Limit:       max + 1,
+		})
+		count = len(qis)
+		return err
+	})
+	if c.Status != HealthOK {
+		return c
+	}
+	c.Message = fmt.Sprintf("%d items due", count)
+	if count > max {
+		c.Status = HealthDegraded
+		c.Message = fmt.Sprintf("more than %d items due", max)
+	}
+	return c
+}
+
+type healthReporterAdapter struct {
+	HealthReporter
+}
+
+// Adapts a HealthReporter into a DetailedHealthReporter with a single backend-check.
+// An unreachable backend does not mean that the connector must be restarted, so the check affects readiness only.
+func AdaptHealthReporter(h HealthReporter) DetailedHealthReporter {
+	return healthReporterAdapter{h}
+}
+
+func (h healthReporterAdapter) GetHealthReport(ctx context.Context) HealthReport {
+	c := RunHealthCheck(HealthCheckBackend, func() error {
+		code, err := h.GetHealth()
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK {
+			return fmt.Errorf("health-check reported status %d", code)
+		}
+		return nil
+	})
+	return HealthReport{
+		Status: c.Status,
+		Checks: []HealthCheck{c},
+	}
+}
+
+// The combined health of all registered connectors, as served by the HealthAggregator.
+type AggregatedHealth struct {
+	Status     HealthStatus
+	Connectors map[string]HealthReport
+}
+
+// Combines the health-reports of all registered connectors into readiness- and liveness-reports.
+type HealthAggregator struct {
+	// The maximum time to wait for each connector
+	Timeout     time.Duration
+	mu          sync.Mutex
+	reporters   map[string]DetailedHealthReporter
+	lastSuccess map[string]time.Time
+}
+
+func NewHealthAggregator(timeout time.Duration) *HealthAggregator {
+	return &HealthAggregator{
+		Timeout:     timeout,
+		reporters:   map[string]DetailedHealthReporter{},
+		lastSuccess: map[string]time.Time{},
+	}
+}
+
+// Registers the connector, if it implements DetailedHealthReporter or HealthReporter.
+// Returns false if the connector does not report health.
+func (h *HealthAggregator) Register(connectorId string, connector interface{}) bool {
+	var r DetailedHealthReporter
+	switch c := connector.(type) {
+	case DetailedHealthReporter:
+		r = c
+	case HealthReporter:
+		r = AdaptHealthReporter(c)
+	default:
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reporters[connectorId] = r
+	return true
+}
+
+// Reports the health of all checks.
+func (h *HealthAggregator) Readiness(ctx context.Context) AggregatedHealth {
+	return h.collect(ctx, false)
+}
+
+// Reports the health of the checks marked with Liveness.
+func (h *HealthAggregator) Liveness(ctx context.Context) AggregatedHealth {
+	return h.collect(ctx, true)
+}
+
+func (h *HealthAggregator) collect(ctx context.Context, livenessOnly bool) AggregatedHealth {
+	h.mu.Lock()
+	reporters := make(map[string]DetailedHealthReporter, len(h.reporters))
+	for id, r := range h.reporters {
+		reporters[id] = r
+	}
+	h.mu.Unlock()
+
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		id     string
+		report HealthReport
+	}
+	results := make(chan result, len(reporters))
+	for id, r := range reporters {
+		go func(id string, r DetailedHealthReporter) {
+			results <- result{id, h.report(ctx, r)}
+		}(id, r)
+	}
+
+	agg := AggregatedHealth{Status: HealthOK, Connectors: map[string]HealthReport{}}
+	var all []HealthCheck
+	for range reporters {
+		res := <-results
+		report := h.trackSuccess(res.id, res.report)
+		if livenessOnly {
+			var checks []HealthCheck
+			for _, c := range report.Checks {
+				if c.Liveness {
+					checks = append(checks, c)
+				}
+			}
+			report.Checks = checks
+		}
+		report.Status = CombineHealthStatus(report.Checks)
+		agg.Connectors[res.id] = report
+		all = append(all, report.Checks...)
+	}
+	agg.Status = CombineHealthStatus(all)
+	return agg
+}
+
+// Runs the reporter, but gives up when the context is done.
+// A reporter that does not complete in time is reported as a backend-check that is down, affecting readiness only.
+func (h *HealthAggregator) report(ctx context.Context, r DetailedHealthReporter) HealthReport {
+	start := time.Now()
+	done := make(chan HealthReport, 1)
+	go func() {
+		done <- r.GetHealthReport(ctx)
+	}()
+	select {
+	case report := <-done:
+		return report
+	case <-ctx.Done():
+		c := HealthCheck{
+			Name:    HealthCheckBackend,
+			Status:  HealthDown,
+			Latency: time.Since(start),
+			Message: fmt.Sprintf("health-report did not complete: %s", ctx.Err()),
+		}
+		return HealthReport{Status: HealthDown, Checks: []HealthCheck{c}}
+	}
+}
+
+// Records successful checks, and fills in LastSuccess where the reporter did not.
+func (h *HealthAggregator) trackSuccess(connectorId string, report HealthReport) HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	checks := make([]HealthCheck, len(report.Checks))
+	for i, c := range report.Checks {
+		key := connectorId + "/" + c.Name
+		if c.Status == HealthOK {
+			h.lastSuccess[key] = now
+		}
+		if c.LastSuccess == nil {
+			if t, ok := h.lastSuccess[key]; ok {
+				t := t
+				c.LastSuccess = &t
+			}
+		}
+		checks[i] = c
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	report.Checks = checks
+	return report
+}
+
+// Serves the readiness-report as JSON. Responds with 503 if any check is down.
+func (h *HealthAggregator) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.Readiness(r.Context()))
+	})
+}
+
+// Serves the liveness-report as JSON. Responds with 503 if any liveness-check is down.
+func (h *HealthAggregator) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.Liveness(r.Context()))
+	})
+}
+
+func writeHealth(w http.ResponseWriter, agg AggregatedHealth) {
+	w.Header().Set("Content-Type", "application/json")
+	if agg.Status == HealthDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(agg)
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type statusReporter struct {
+	code int
+	err  error
+}
+
+func (s statusReporter) GetHealth() (int, error) { return s.code, s.err }
+
+type detailedReporter []HealthCheck
+
+func (d detailedReporter) GetHealthReport(ctx context.Context) HealthReport {
+	return HealthReport{Checks: d}
+}
+
+type slowReporter struct{}
+
+func (slowReporter) GetHealthReport(ctx context.Context) HealthReport {
+	time.Sleep(time.Second)
+	return HealthReport{}
+}
+
+func TestHealthAggregator(t *testing.T) {
+	h := NewHealthAggregator(50 * time.Millisecond)
+	assert.True(t, h.Register("ok", statusReporter{code: http.StatusOK}))
+	assert.True(t, h.Register("detailed", detailedReporter{
+		{Name: HealthCheckBackend, Status: HealthOK, Liveness: true},
+		{Name: HealthCheckQueue, Status: HealthDown},
+	}))
+	assert.False(t, h.Register("none", struct{}{}))
+
+	ready := h.Readiness(context.Background())
+	assert.Equal(t, HealthDown, ready.Status)
+	assert.Equal(t, HealthOK, ready.Connectors["ok"].Status)
+	assert.NotNil(t, ready.Connectors["ok"].Checks[0].LastSuccess)
+	assert.Equal(t, HealthDown, ready.Connectors["detailed"].Status)
+
+	live := h.Liveness(context.Background())
+	assert.Equal(t, HealthOK, live.Status)
+	assert.Len(t, live.Connectors["detailed"].Checks, 1)
+
+	h.Register("failing", statusReporter{code: http.StatusInternalServerError, err: errors.New("unreachable")})
+	h.Register("slow", slowReporter{})
+	// Backend-checks and timeouts affect readiness only
+	live = h.Liveness(context.Background())
+	assert.Equal(t, HealthOK, live.Status)
+	assert.Empty(t, live.Connectors["failing"].Checks)
+	assert.Empty(t, live.Connectors["slow"].Checks)
+
+	ready = h.Readiness(context.Background())
+	assert.Equal(t, "unreachable", ready.Connectors["failing"].Checks[0].Message)
+	assert.Equal(t, HealthDown, ready.Connectors["slow"].Status)
+
+	w := httptest.NewRecorder()
+	h.ReadinessHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HMAC request-signing for machine-clients, like watch-folders and gateways.
+//
+// The client signs every request with a secret shared with Proxy, so that the secret is never sent.
+// The signature is calculated as follows:
+//
+//	content-sha256 = lowercase hex( SHA256(body) )              // the empty body is hashed for requests without one
+//	canonical      = METHOD + "\n" +                            // uppercase, e.g. PATCH
+//	                 PATH + "\n" +                              // escaped path, including "?" and the raw query if any
+//	                 DATE + "\n" +                              // the Date-header, as sent, in http-date format
+//	                 NONCE + "\n" +                             // random, unique for every request
+//	                 content-sha256
+//	signature      = base64( HMAC-SHA256(secret, canonical) )   // standard base64, with padding
+//
+// The request must then include the headers:
+//
+//	Date: Mon, 02 Jan 2006 15:04:05 GMT
+//	X-Content-SHA256: <content-sha256>
+//	Authorization: HMAC-SHA256 Credential=<client-id>, Nonce=<nonce>, Signature=<signature>
+//
+// Requests with a Date outside the allowed clock-skew, or with a nonce already seen, are rejected.
+const (
+	HMACScheme              = "HMAC-SHA256"
+	HMACContentSha256Header = "X-Content-SHA256"
+)
+
+// Provides the shared secret of a client.
+type HMACSecrets interface {
+	HMACSecret(clientId string) (secret []byte, found bool, err error)
+}
+
+type StaticHMACSecrets map[string]string
+
+func (s StaticHMACSecrets) HMACSecret(clientId string) ([]byte, bool, error) {
+	secret, ok := s[clientId]
+	return []byte(secret), ok, nil
+}
+
+// Returns the canonical string that is signed, as described above.
+func HMACCanonicalString(method, path, date, nonce, contentSha256 string) string {
+	return strings.Join([]string{strings.ToUpper(method), path, date, nonce, contentSha256}, "\n")
+}
+
+func hmacSignature(secret []byte, canonical string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hmacPath(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	return path
+}
+
+// Reads the whole body, and replaces it so that it can be read again.
+func readBody(r *http.Request, max int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, fmt.Errorf("body exceeds %d bytes", max)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// Client-side signer for requests to Proxy.
+type HMACSigner struct {
+	ClientId string
+	Secret   []byte
+	now      func() time.Time
+}
+
+func NewHMACSigner(clientId string, secret []byte) *HMACSigner {
+	return &HMACSigner{ClientId: clientId, Secret: secret, now: time.Now}
+}
+
+// Signs the request by setting the Date, X-Content-SHA256 and Authorization-headers.
+// The body is read and replaced.
+func (s *HMACSigner) Sign(r *http.Request) error {
+	body, err := readBody(r, 1<<62)
+	if err != nil {
+		return fmt.Errorf("failed to read body for signing: %w", err)
+	}
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(n)
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	date := s.now().UTC().Format(http.TimeFormat)
+
+	sig := hmacSignature(s.Secret, HMACCanonicalString(r.Method, hmacPath(r), date, nonce, digest))
+	r.Header.Set("Date", date)
+	r.Header.Set(HMACContentSha256Header, digest)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Nonce=%s, Signature=%s", HMACScheme, s.ClientId, nonce, sig))
+	return nil
+}
+
+// Remembers nonces for a limited time, to protect against replayed requests.
+type NonceCache struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	// The nonces in the order they were used. As the ttl is the same for all, this is also the order they expire in.
+	order []string
+	now   func() time.Time
+}
+
+func NewNonceCache(ttl time.Duration) *NonceCache {
+	return &NonceCache{ttl: ttl, nonces: map[string]time.Time{}, now: time.Now}
+}
+
+// Returns false if the nonce has already been seen within the ttl.
+func (n *NonceCache) Use(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+	n.expire(now)
+	if _, ok := n.nonces[nonce]; ok {
+		return false
+	}
+	n.nonces[nonce] = now.Add(n.ttl)
+	n.order = append(n.order, nonce)
+	return true
+}
+
+// Forgets the expired nonces, which are at the front of the order.
+func (n *NonceCache) expire(now time.Time) {
+	i := 0
+	for ; i < len(n.order) && now.After(n.nonces[n.order[i]]); i++ {
+		delete(n.nonces, n.order[i])
+	}
+	n.order = n.order[i:]
+}
+
+// Authenticator verifying requests signed with HMACSigner.
+type HMACAuthenticator struct {
+	Secrets HMACSecrets
+	// The allowed difference between the Date-header and the server's clock. Defaults to 5 minutes.
+	MaxSkew time.Duration
+	// The largest body that will be verified. Defaults to 64 MB.
+	MaxBodySize int64
+	nonces      *NonceCache
+	now         func() time.Time
+}
+
+func NewHMACAuthenticator(secrets HMACSecrets, maxSkew time.Duration) *HMACAuthenticator {
+	if maxSkew <= 0 {
+		maxSkew = 5 * time.Minute
+	}
+	return &HMACAuthenticator{
+		Secrets:     secrets,
+		MaxSkew:     maxSkew,
+		MaxBodySize: 64 << 20,
+		// A nonce only needs to be remembered as long as its Date is accepted
+		nonces: NewNonceCache(2 * maxSkew),
+		now:    time.Now,
+	}
+}
+
+type hmacAuthorization struct {
+	credential, nonce, signature string
+}
+
+func parseHMACAuthorization(h string) (hmacAuthorization, bool) {
+	var a hmacAuthorization
+	if !strings.HasPrefix(h, HMACScheme+" ") {
+		return a, false
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(h, HMACScheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Credential":
+			a.credential = kv[1]
+		case "Nonce":
+			a.nonce = kv[1]
+		case "Signature":
+			a.signature = kv[1]
+		}
+	}
+	return a, true
+}
+
+func (h *HMACAuthenticator) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := h.AuthenticateIdentity(r, a)
+	return err
+}
+
+// The identity is the ClientId of the secret the request was signed with.
+func (h *HMACAuthenticator) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	auth, ok := parseHMACAuthorization(r.Header.Get("Authorization"))
+	if !ok {
+		return VerifiedIdentity{}, fmt.Errorf("%w: missing %s-signature", ErrNoCredentials, HMACScheme)
+	}
+	if auth.credential == "" || auth.nonce == "" || auth.signature == "" {
+		return VerifiedIdentity{}, fmt.Errorf("%w: incomplete %s-signature", ErrInvalidCredentials, HMACScheme)
+	}
+	if a.ClientId != "" && a.ClientId != auth.credential {
+		return VerifiedIdentity{}, fmt.Errorf("%w: the signature does not belong to client-id '%s'", ErrInvalidCredentials, a.ClientId)
+	}
+	date := r.Header.Get("Date")
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return VerifiedIdentity{}, fmt.Errorf("%w: missing or invalid Date-header", ErrInvalidCredentials)
+	}
+	if skew := h.now().Sub(t); skew > h.MaxSkew || skew < -h.MaxSkew {
+		return VerifiedIdentity{}, fmt.Errorf("%w: the Date-header is outside the allowed clock-skew", ErrInvalidCredentials)
+	}
+	secret, found, err := h.Secrets.HMACSecret(auth.credential)
+	if err != nil {
+		return VerifiedIdentity{}, err
+	}
+	if !found {
+		return VerifiedIdentity{}, fmt.Errorf("%w: unknown client-id '%s'", ErrInvalidCredentials, auth.credential)
+	}
+
+	digest := r.Header.Get(HMACContentSha256Header)
+	body, err := readBody(r, h.MaxBodySize)
+	if err != nil {
+		return VerifiedIdentity{}, fmt.Errorf("%w: %s", ErrInvalidCredentials, err)
+	}
+	sum := sha256.Sum256(body)
+	if !hmac.Equal([]byte(strings.ToLower(digest)), []byte(hex.EncodeToString(sum[:]))) {
+		return VerifiedIdentity{}, fmt.Errorf("%w: the body does not match %s", ErrInvalidCredentials, HMACContentSha256Header)
+	}
+	expected := hmacSignature(secret, HMACCanonicalString(r.Method, hmacPath(r), date, auth.nonce, digest))
+	if !hmac.Equal([]byte(expected), []byte(auth.signature)) {
+		return VerifiedIdentity{}, fmt.Errorf("%w: invalid signature", ErrInvalidCredentials)
+	}
+	// The nonce is only recorded for valid signatures, so that it cannot be burned by others.
+	if !h.nonces.Use(auth.credential + ":" + auth.nonce) {
+		return VerifiedIdentity{}, fmt.Errorf("%w: the request has already been used", ErrInvalidCredentials)
+	}
+	return VerifiedIdentity{ClientId: auth.credential}, nil
+}
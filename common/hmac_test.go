@@ -0,0 +1,70 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	now := time.Date(2021, 5, 12, 12, 0, 0, 0, time.UTC)
+	auth := NewHMACAuthenticator(StaticHMACSecrets{"watch-folder": "secret"}, time.Minute)
+	auth.now = func() time.Time { return now }
+	signer := NewHMACSigner("watch-folder", []byte("secret"))
+	signer.now = func() time.Time { return now }
+
+	signed := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPatch, "/files/abc?x=1", strings.NewReader(body))
+		assert.NoError(t, signer.Sign(r))
+		return r
+	}
+
+	r := signed("chunk")
+	assert.NoError(t, auth.Authenticate(r, AuthenticationPayload{}))
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(auth.Authenticate(r, AuthenticationPayload{})), "replayed requests should be rejected")
+
+	tampered := signed("chunk")
+	tampered.Body = http.NoBody
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(auth.Authenticate(tampered, AuthenticationPayload{})))
+
+	tampered = signed("chunk")
+	tampered.URL.Path = "/files/other"
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(auth.Authenticate(tampered, AuthenticationPayload{})))
+
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(auth.Authenticate(signed("chunk"), AuthenticationPayload{ClientId: "gateway"})))
+
+	late := signed("chunk")
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusForbidden, AuthenticationStatusCode(auth.Authenticate(late, AuthenticationPayload{})))
+
+	unsigned := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Equal(t, http.StatusUnauthorized, AuthenticationStatusCode(auth.Authenticate(unsigned, AuthenticationPayload{})))
+}
+
+func TestHMACCanonicalString(t *testing.T) {
+	// Reference-values for client-implementations
+	canonical := HMACCanonicalString("patch", "/files/abc", "Wed, 12 May 2021 12:00:00 GMT", "0123456789abcdef",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	assert.Equal(t, "PATCH\n/files/abc\nWed, 12 May 2021 12:00:00 GMT\n0123456789abcdef\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", canonical)
+	assert.Equal(t, "SLYYCe09opBADgBmO47jVUYI8CeVNbwcE9ENLHQcBR0=", hmacSignature([]byte("secret"), canonical))
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Date(2021, 5, 12, 0, 0, 0, 0, time.UTC)
+	n := NewNonceCache(time.Minute)
+	n.now = func() time.Time { return now }
+
+	assert.True(t, n.Use("a"))
+	assert.False(t, n.Use("a"))
+	now = now.Add(30 * time.Second)
+	assert.True(t, n.Use("b"))
+
+	now = now.Add(31 * time.Second)
+	assert.True(t, n.Use("a"), "a has expired")
+	assert.False(t, n.Use("b"))
+	assert.Equal(t, []string{"b", "a"}, n.order)
+}
@@ -0,0 +1,284 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrImpersonationDenied = errors.New("the client is not allowed to act on behalf of the user")
+)
+
+// Allows a client to act on behalf of users, through the as-user-fields.
+type ImpersonationRule struct {
+	ClientId string
+	// Users the client may act as. Every as-user-field that is set must be listed, e.g. both the UserName and the
+	// UserId. "*" allows any user.
+	Users []string
+	// Active Directory group-SIDs. The client may act as any UserSid that is a member of one of these groups.
+	// Requires a GroupResolver.
+	Groups []string
+}
+
+// Resolves the Active Directory groups of a user. Typically implemented by connectors with access to AD or LDAP.
+type GroupResolver interface {
+	GroupsForSid(ctx context.Context, userSid string) ([]string, error)
+}
+
+type ImpersonationRecord struct {
+	Time     time.Time
+	ClientId string
+	UserName string `json:",omitempty"`
+	UserId   string `json:",omitempty"`
+	UserSid  string `json:",omitempty"`
+	ReqId    string `json:",omitempty"`
+	// The ClientMediaId of the upload
+	ClientMediaId string `json:",omitempty"`
+	Allowed       bool
+	Reason        string `json:",omitempty"`
+}
+
+type ImpersonationAuditor interface {
+	RecordImpersonation(r ImpersonationRecord) error
+}
+
+// Writes impersonation-records to the log.
+type LogImpersonationAuditor struct {
+	L logrus.FieldLogger
+}
+
+func (l LogImpersonationAuditor) RecordImpersonation(r ImpersonationRecord) error {
+	entry := l.L.WithFields(map[string]interface{}{
+		"clientId":      r.ClientId,
+		"asUserName":    r.UserName,
+		"asUserId":      r.UserId,
+		"asUserSid":     r.UserSid,
+		"reqId":         r.ReqId,
+		"clientMediaId": r.ClientMediaId,
+	})
+	if r.Allowed {
+		entry.Info("Impersonated upload")
+		return nil
+	}
+	entry.WithField("reason", r.Reason).Warn("Impersonation denied")
+	return nil
+}
+
+// Stores impersonation-records in Persistence, one key per record. The records of a day are numbered, under the keys
+// 'impersonation:2006-01-02:0', 'impersonation:2006-01-02:1' and so on, while the key 'impersonation:2006-01-02'
+// holds the number of records. Use GetImpersonationRecords to read them.
+type PersistenceImpersonationAuditor struct {
+	P  Persistence
+	mu sync.Mutex
+}
+
+// The key holding the number of records of the day.
+func ImpersonationAuditKey(day time.Time) string {
+	return "impersonation:" + day.UTC().Format("2006-01-02")
+}
+
+func impersonationRecordKey(day time.Time, n int) string {
+	return fmt.Sprintf("%s:%d", ImpersonationAuditKey(day), n)
+}
+
+func (p *PersistenceImpersonationAuditor) RecordImpersonation(r ImpersonationRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := ImpersonationAuditKey(r.Time)
+	var count int
+	if _, err := p.P.Get(key, &count); err != nil {
+		return fmt.Errorf("failed to get the number of impersonation-records: %w", err)
+	}
+	// The record is stored before it is counted, so that a counted record is never missing.
+	if err := p.P.Set(impersonationRecordKey(r.Time, count), r); err != nil {
+		return fmt.Errorf("failed to store impersonation-record: %w", err)
+	}
+	if err := p.P.Set(key, count+1); err != nil {
+		return fmt.Errorf("failed to store the number of impersonation-records: %w", err)
+	}
+	return nil
+}
+
+// Returns the records of the day stored by PersistenceImpersonationAuditor.
+func GetImpersonationRecords(p Persistence, day time.Time) ([]ImpersonationRecord, error) {
+	var count int
+	if _, err := p.Get(ImpersonationAuditKey(day), &count); err != nil {
+		return nil, fmt.Errorf("failed to get the number of impersonation-records: %w", err)
+	}
+	records := make([]ImpersonationRecord, 0, count)
+	for n := 0; n < count; n++ {
+		var r ImpersonationRecord
+		if _, err := p.Get(impersonationRecordKey(day, n), &r); err != nil {
+			return nil, fmt.Errorf("failed to get impersonation-record: %w", err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+type ImpersonationPolicy struct {
+	Rules []ImpersonationRule
+	// Required for rules using Groups
+	Groups GroupResolver
+	// Every impersonated upload is recorded, including denied ones.
+	Auditor ImpersonationAuditor
+}
+
+// Reports whether the payload acts on behalf of a user.
+func Impersonating(a AuthenticationPayload) bool {
+	return a.UserName != "" || a.UserId != "" || a.UserSid != ""
+}
+
+// Returns an error wrapping ErrImpersonationDenied if the client is not allowed to act as the user in the payload.
+//
+// Every as-user-field that is set must be permitted on its own, so that a permitted UserName cannot carry a
+// UserId or UserSid of another user. Group-rules only permit the UserSid, as that is what the groups are resolved for.
+func (p *ImpersonationPolicy) Check(ctx context.Context, a AuthenticationPayload) error {
+	if !Impersonating(a) {
+		return nil
+	}
+	var rules []ImpersonationRule
+	for _, rule := range p.Rules {
+		if rule.ClientId == a.ClientId {
+			rules = append(rules, rule)
+		}
+	}
+	fields := []struct{ name, value string }{
+		{"user-name", a.UserName},
+		{"user-id", a.UserId},
+		{"user-sid", a.UserSid},
+	}
+	for _, f := range fields {
+		if f.value == "" || permitsUser(rules, f.value) {
+			continue
+		}
+		if f.name == "user-sid" {
+			ok, err := p.permitsGroupMember(ctx, rules, a.UserSid)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+		return fmt.Errorf("%w: client '%s' as %s '%s'", ErrImpersonationDenied, a.ClientId, f.name, f.value)
+	}
+	return nil
+}
+
+func permitsUser(rules []ImpersonationRule, user string) bool {
+	for _, rule := range rules {
+		for _, u := range rule.Users {
+			if u == "*" || u == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether the user is a member of any of the groups of the rules.
+func (p *ImpersonationPolicy) permitsGroupMember(ctx context.Context, rules []ImpersonationRule, userSid string) (bool, error) {
+	var groupRules []ImpersonationRule
+	for _, rule := range rules {
+		if len(rule.Groups) > 0 {
+			groupRules = append(groupRules, rule)
+		}
+	}
+	if len(groupRules) == 0 || p.Groups == nil {
+		return false, nil
+	}
+	groups, err := p.Groups.GroupsForSid(ctx, userSid)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve groups for '%s': %w", userSid, err)
+	}
+	for _, rule := range groupRules {
+		for _, g := range rule.Groups {
+			if contains(groups, g) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Returns the client of the VerifiedIdentity on the context, with the as-user-fields of the metadata, as those are
+// the ones the connector acts on. The client-id of the metadata is ignored, as it may have been written by the client.
+// User-fields proven by the identity, e.g. those of a JWT, are not impersonation, and are left out.
+func impersonationPayloadFor(ctx context.Context, data *metadata.Metadata) AuthenticationPayload {
+	id, _ := VerifiedIdentityFromContext(ctx)
+	a, _ := AuthenticationPayloadFromContext(ctx)
+	a.ClientId = id.ClientId
+	if v := data.GetRaw(metadata.AsUserName); v != "" {
+		a.UserName = v
+	}
+	if v := data.GetRaw(metadata.AsUserId); v != "" {
+		a.UserId = v
+	}
+	if v := data.GetRaw(metadata.AsUserActiveDirectorySid); v != "" {
+		a.UserSid = v
+	}
+	if a.UserName == id.UserName {
+		a.UserName = ""
+	}
+	if a.UserId == id.UserId {
+		a.UserId = ""
+	}
+	if a.UserSid == id.UserSid {
+		a.UserSid = ""
+	}
+	return a
+}
+
+// Checks the as-user-fields of an upload, and records the outcome with the Auditor.
+func (p *ImpersonationPolicy) CheckUpload(ctx context.Context, data *metadata.Metadata) error {
+	a := impersonationPayloadFor(ctx, data)
+	if !Impersonating(a) {
+		return nil
+	}
+	err := p.Check(ctx, a)
+	if p.Auditor == nil {
+		return err
+	}
+	reqId := data.GetReqId()
+	if reqId == "" {
+		reqId = ReqIdFromContext(ctx)
+	}
+	record := ImpersonationRecord{
+		Time:          time.Now(),
+		ClientId:      a.ClientId,
+		UserName:      a.UserName,
+		UserId:        a.UserId,
+		UserSid:       a.UserSid,
+		ReqId:         reqId,
+		ClientMediaId: data.GetUploadMetadata().ClientMediaId,
+		Allowed:       err == nil,
+	}
+	if err != nil {
+		record.Reason = err.Error()
+	}
+	if auditErr := p.Auditor.RecordImpersonation(record); auditErr != nil {
+		// An upload that cannot be audited must not go through
+		return fmt.Errorf("failed to audit impersonation: %w", auditErr)
+	}
+	return err
+}
+
+// NewUploadInitiator that is only called if the client is allowed to act as the user of the upload.
+type ImpersonationCheckedUploadInitiator struct {
+	NewUploadInitiator
+	Policy *ImpersonationPolicy
+}
+
+func (u ImpersonationCheckedUploadInitiator) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	if err := u.Policy.CheckUpload(ctx, data); err != nil {
+		return err
+	}
+	return u.NewUploadInitiator.InitiateNewUpload(ctx, data)
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticGroups map[string][]string
+
+func (s staticGroups) GroupsForSid(ctx context.Context, sid string) ([]string, error) {
+	return s[sid], nil
+}
+
+func TestImpersonationPolicy(t *testing.T) {
+	p := newMemoryPersistence()
+	policy := &ImpersonationPolicy{
+		Rules: []ImpersonationRule{
+			{ClientId: "gateway", Users: []string{"jane"}},
+			{ClientId: "watch-folder", Groups: []string{"S-1-5-21-513"}},
+		},
+		Groups:  staticGroups{"S-1-5-21-1001": {"S-1-5-21-513"}},
+		Auditor: &PersistenceImpersonationAuditor{P: p},
+	}
+	ctx := context.Background()
+
+	assert.NoError(t, policy.Check(ctx, AuthenticationPayload{ClientId: "gateway"}), "no impersonation")
+	assert.NoError(t, policy.Check(ctx, AuthenticationPayload{ClientId: "gateway", UserName: "jane"}))
+	assert.True(t, errors.Is(policy.Check(ctx, AuthenticationPayload{ClientId: "gateway", UserName: "john"}), ErrImpersonationDenied))
+	assert.NoError(t, policy.Check(ctx, AuthenticationPayload{ClientId: "watch-folder", UserSid: "S-1-5-21-1001"}))
+	assert.Error(t, policy.Check(ctx, AuthenticationPayload{ClientId: "watch-folder", UserSid: "S-1-5-21-1002"}))
+	assert.Error(t, policy.Check(ctx, AuthenticationPayload{ClientId: "gateway", UserSid: "S-1-5-21-1001"}))
+
+	// Every as-user-field must be permitted, not just one of them
+	assert.True(t, errors.Is(policy.Check(ctx, AuthenticationPayload{ClientId: "gateway", UserName: "jane", UserId: "john"}), ErrImpersonationDenied))
+	assert.True(t, errors.Is(policy.Check(ctx, AuthenticationPayload{ClientId: "gateway", UserName: "jane", UserSid: "S-1-5-21-1001"}), ErrImpersonationDenied))
+	assert.True(t, errors.Is(policy.Check(ctx, AuthenticationPayload{ClientId: "watch-folder", UserName: "admin", UserSid: "S-1-5-21-1001"}), ErrImpersonationDenied), "groups only permit the sid")
+	assert.NoError(t, (&ImpersonationPolicy{Rules: []ImpersonationRule{{ClientId: "gateway", Users: []string{"*"}}}}).Check(ctx, AuthenticationPayload{ClientId: "gateway", UserName: "jane", UserId: "john"}))
+
+	i := &initiator{}
+	u := ImpersonationCheckedUploadInitiator{i, policy}
+	data := metadata.UploadMetadata{ClientMediaId: "abc"}.ConvertToMetaData()
+	data.SetClientId("gateway").SetAsUserName("jane")
+	assert.Error(t, u.InitiateNewUpload(ctx, &data), "the client-id of the metadata is not trusted")
+	ctx = ContextWithVerifiedIdentity(ctx, VerifiedIdentity{ClientId: "gateway"})
+	data.SetAsUserName("john")
+	assert.Error(t, u.InitiateNewUpload(ctx, &data))
+	assert.False(t, i.called)
+	data.SetAsUserName("jane")
+	assert.NoError(t, u.InitiateNewUpload(ctx, &data))
+	assert.True(t, i.called)
+
+	// The user proven by a JWT is not impersonated
+	i.called = false
+	jwt := ContextWithVerifiedIdentity(context.Background(), VerifiedIdentity{ClientId: "mobile", UserName: "john", UserId: "u-2"})
+	jwt = ContextWithAuthenticationPayload(jwt, AuthenticationPayload{ClientId: "mobile", UserName: "john", UserId: "u-2"})
+	data = metadata.UploadMetadata{ClientMediaId: "def"}.ConvertToMetaData()
+	assert.NoError(t, u.InitiateNewUpload(jwt, &data))
+	assert.True(t, i.called)
+	data.SetAsUserName("jane")
+	assert.True(t, errors.Is(u.InitiateNewUpload(jwt, &data), ErrImpersonationDenied))
+
+	records, err := GetImpersonationRecords(p, time.Now())
+	assert.NoError(t, err)
+	if assert.Len(t, records, 4) {
+		assert.False(t, records[0].Allowed)
+		assert.False(t, records[1].Allowed)
+		assert.True(t, records[2].Allowed)
+		assert.Equal(t, "abc", records[2].ClientMediaId)
+		assert.Equal(t, "mobile", records[3].ClientId)
+		assert.Equal(t, "jane", records[3].UserName)
+		assert.Empty(t, records[3].UserId)
+	}
+}
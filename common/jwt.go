@@ -0,0 +1,493 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("no key found for the token")
+	ErrInvalidJWTOptions = errors.New("invalid jwt-options")
+)
+
+// A set of public keys, as a JSON Web Key Set, read from a file or an url.
+//
+// The keys are cached for the TTL, which defaults to an hour. If a token is signed with an unknown key, the keys are refreshed,
+// but no more often than MinRefreshInterval. Concurrent refreshes share a single fetch.
+// Keys of unsupported types or curves are skipped, and logged if L is set.
+type JWKS struct {
+	// Path or url of the key-set
+	Source             string
+	TTL                time.Duration
+	MinRefreshInterval time.Duration
+	Client             *http.Client
+	L                  logrus.FieldLogger
+	mu                 sync.Mutex
+	keys               []jwk
+	fetchedAt          time.Time
+	// Closed when the fetch in progress completes
+	fetching chan struct{}
+	fetchErr error
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	key crypto.PublicKey
+}
+
+func NewJWKS(source string, ttl time.Duration) *JWKS {
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return &JWKS{
+		Source:             source,
+		TTL:                ttl,
+		MinRefreshInterval: time.Minute,
+		Client:             &http.Client{Timeout: 10 * time.Second},
+		L:                  logrus.StandardLogger(),
+	}
+}
+
+// Returns the keys matching the kid. If kid is empty, all keys are returned.
+func (j *JWKS) Keys(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	now := time.Now()
+	keys, fetchedAt := j.find(kid)
+	if fetchedAt.IsZero() || now.Sub(fetchedAt) > j.TTL {
+		if err := j.refresh(ctx); err != nil && fetchedAt.IsZero() {
+			return nil, err
+		}
+		keys, fetchedAt = j.find(kid)
+	}
+	if len(keys) == 0 && now.Sub(fetchedAt) > j.MinRefreshInterval {
+		if err := j.refresh(ctx); err != nil {
+			return nil, err
+		}
+		keys, _ = j.find(kid)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: kid '%s'", ErrUnknownSigningKey, kid)
+	}
+	return keys, nil
+}
+
+func (j *JWKS) find(kid string) (keys []crypto.PublicKey, fetchedAt time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, k := range j.keys {
+		if kid == "" || k.Kid == kid {
+			keys = append(keys, k.key)
+		}
+	}
+	return keys, j.fetchedAt
+}
+
+// Fetches the key-set, without holding the lock. Callers arriving while a fetch is in progress wait for its result.
+func (j *JWKS) refresh(ctx context.Context) error {
+	j.mu.Lock()
+	if ch := j.fetching; ch != nil {
+		j.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return j.fetchErr
+	}
+	ch := make(chan struct{})
+	j.fetching = ch
+	j.mu.Unlock()
+
+	keys, err := j.fetch(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err == nil {
+		j.keys = keys
+		j.fetchedAt = time.Now()
+	}
+	j.fetchErr = err
+	j.fetching = nil
+	close(ch)
+	return err
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]jwk, error) {
+	b, err := j.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key-set from '%s': %w", j.Source, err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key-set from '%s': %w", j.Source, err)
+	}
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Key-sets commonly hold keys for other algorithms, which must not prevent the others from being used
+			if j.L != nil {
+				j.L.WithError(err).WithField("kid", k.Kid).Warnf("Skipping key in key-set from '%s'", j.Source)
+			}
+			continue
+		}
+		k.key = key
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (j *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(j.Source, "http://") && !strings.HasPrefix(j.Source, "https://") {
+		return os.ReadFile(j.Source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := j.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519-key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key-type '%s'", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+type JWTOptions struct {
+	// Required value of the iss-claim. Must be set
+	Issuer string
+	// Required value of the aud-claim. Must be set
+	Audience string
+	// Allowed clock-skew when checking exp and nbf
+	Leeway time.Duration
+	// The claims mapped onto the AuthenticationPayload. Defaults to preferred_username and sub.
+	UserNameClaim string
+	UserIdClaim   string
+	UserSidClaim  string
+	// The claim holding the client-id of the VerifiedIdentity. Defaults to azp.
+	ClientIdClaim string
+}
+
+// Authenticator verifying JWT access-tokens, as issued by an OIDC-provider, against a JWKS.
+// Supported algorithms are RS256, ES256 and EdDSA.
+type JWTAuthenticator struct {
+	Keys    *JWKS
+	Options JWTOptions
+	now     func() time.Time
+}
+
+func NewJWTAuthenticator(keys *JWKS, o JWTOptions) (*JWTAuthenticator, error) {
+	if o.Issuer == "" {
+		return nil, fmt.Errorf("%w: the issuer is required", ErrInvalidJWTOptions)
+	}
+	if o.Audience == "" {
+		return nil, fmt.Errorf("%w: the audience is required", ErrInvalidJWTOptions)
+	}
+	if o.UserNameClaim == "" {
+		o.UserNameClaim = "preferred_username"
+	}
+	if o.UserIdClaim == "" {
+		o.UserIdClaim = "sub"
+	}
+	if o.ClientIdClaim == "" {
+		o.ClientIdClaim = "azp"
+	}
+	return &JWTAuthenticator{
+		Keys:    keys,
+		Options: o,
+		now:     time.Now,
+	}, nil
+}
+
+type JWTClaims map[string]interface{}
+
+func (c JWTClaims) String(key string) string {
+	switch v := c[key].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+func (c JWTClaims) time(key string) (time.Time, bool) {
+	n, ok := c[key].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func (c JWTClaims) hasAudience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (j *JWTAuthenticator) Authenticate(r *http.Request, a AuthenticationPayload) error {
+	_, err := j.AuthenticationPayload(r, a)
+	return err
+}
+
+// The identity is the one of the claims of the bearer-token.
+func (j *JWTAuthenticator) AuthenticateIdentity(r *http.Request, a AuthenticationPayload) (VerifiedIdentity, error) {
+	claims, err := j.verifyRequest(r)
+	if err != nil {
+		return VerifiedIdentity{}, err
+	}
+	return j.identity(claims), nil
+}
+
+// Verifies the bearer-token of the request, and returns the AuthenticationPayload with the user-fields
+// mapped from the claims.
+func (j *JWTAuthenticator) AuthenticationPayload(r *http.Request, a AuthenticationPayload) (AuthenticationPayload, error) {
+	claims, err := j.verifyRequest(r)
+	if err != nil {
+		return a, err
+	}
+	return withUserFields(a, j.identity(claims)), nil
+}
+
+func (j *JWTAuthenticator) verifyRequest(r *http.Request) (JWTClaims, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return nil, fmt.Errorf("%w: missing bearer-token", ErrNoCredentials)
+	}
+	return j.Verify(r.Context(), token)
+}
+
+// Returns the identity proven by the claims.
+func (j *JWTAuthenticator) identity(claims JWTClaims) VerifiedIdentity {
+	id := VerifiedIdentity{
+		ClientId: claims.String(j.Options.ClientIdClaim),
+		UserName: claims.String(j.Options.UserNameClaim),
+		UserId:   claims.String(j.Options.UserIdClaim),
+	}
+	if j.Options.UserSidClaim != "" {
+		id.UserSid = claims.String(j.Options.UserSidClaim)
+	}
+	return id
+}
+
+// Replaces the user-fields of the payload with those of the identity that are set.
+func withUserFields(a AuthenticationPayload, id VerifiedIdentity) AuthenticationPayload {
+	if id.UserName != "" {
+		a.UserName = id.UserName
+	}
+	if id.UserId != "" {
+		a.UserId = id.UserId
+	}
+	if id.UserSid != "" {
+		a.UserSid = id.UserSid
+	}
+	return a
+}
+
+// Middleware that verifies the bearer-token, and stores the mapped AuthenticationPayload on the request-context,
+// along with the VerifiedIdentity of the claims. Should be used after ContextMiddleware.
+func (j *JWTAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := j.verifyRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), AuthenticationStatusCode(err))
+			return
+		}
+		id := j.identity(claims)
+		a, _ := AuthenticationPayloadFromContext(r.Context())
+		ctx := ContextWithAuthenticationPayload(r.Context(), withUserFields(a, id))
+		next.ServeHTTP(w, r.WithContext(ContextWithVerifiedIdentity(ctx, id)))
+	})
+}
+
+// Verifies the signature and the claims of the token.
+func (j *JWTAuthenticator) Verify(ctx context.Context, token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header: %s", ErrInvalidCredentials, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidCredentials)
+	}
+	keys, err := j.Keys.Keys(ctx, header.Kid)
+	if err != nil {
+		if errors.Is(err, ErrUnknownSigningKey) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, err)
+		}
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifyJWTSignature(header.Alg, key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidCredentials)
+	}
+
+	var claims JWTClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims: %s", ErrInvalidCredentials, err)
+	}
+	now := j.now()
+	exp, ok := claims.time("exp")
+	if !ok || now.After(exp.Add(j.Options.Leeway)) {
+		return nil, fmt.Errorf("%w: token is expired", ErrInvalidCredentials)
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(j.Options.Leeway).Before(nbf) {
+		return nil, fmt.Errorf("%w: token is not yet valid", ErrInvalidCredentials)
+	}
+	if j.Options.Issuer == "" || claims.String("iss") != j.Options.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer '%s'", ErrInvalidCredentials, claims.String("iss"))
+	}
+	if j.Options.Audience == "" || !claims.hasAudience(j.Options.Audience) {
+		return nil, fmt.Errorf("%w: token is not issued for this audience", ErrInvalidCredentials)
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s)
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(k, signed, sig)
+	}
+	return false
+}
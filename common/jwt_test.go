@@ -0,0 +1,176 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		d := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, d[:])
+	case *ecdsa.PrivateKey:
+		d := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, d[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	ecKey.X.FillBytes(x)
+	ecKey.Y.FillBytes(y)
+	set, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(x), "y": b64(y)},
+		{"kid": "ed", "kty": "OKP", "crv": "Ed25519", "x": b64(edPub)},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, set, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewJWTAuthenticator(NewJWKS(path, time.Hour), JWTOptions{Issuer: "https://idp.example.com"})
+	assert.True(t, errors.Is(err, ErrInvalidJWTOptions), "the audience is required")
+	j, err := NewJWTAuthenticator(NewJWKS(path, time.Hour), JWTOptions{
+		Issuer:       "https://idp.example.com",
+		Audience:     "proxy",
+		UserSidClaim: "onprem_sid",
+	})
+	assert.NoError(t, err)
+	now := time.Now()
+	claims := func(mod func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                "https://idp.example.com",
+			"aud":                []string{"proxy", "other"},
+			"exp":                now.Add(time.Minute).Unix(),
+			"sub":                "user-123",
+			"preferred_username": "jane",
+			"onprem_sid":         "S-1-5-21-1001",
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", rsaKey, claims(nil)), http.StatusOK},
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, claims(nil)), http.StatusOK},
+		{"EdDSA", signJWT(t, "EdDSA", "ed", edKey, claims(nil)), http.StatusOK},
+		{"wrong key", signJWT(t, "RS256", "rsa", otherKey, claims(nil)), http.StatusForbidden},
+		{"unknown kid", signJWT(t, "RS256", "unknown", rsaKey, claims(nil)), http.StatusForbidden},
+		{"expired", signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() })), http.StatusForbidden},
+		{"wrong issuer", signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), http.StatusForbidden},
+		{"wrong audience", signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["aud"] = "other" })), http.StatusForbidden},
+		{"malformed", "abc.def", http.StatusForbidden},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			a, err := j.AuthenticationPayload(r, AuthenticationPayload{ClientId: "app"})
+			assert.Equal(t, tt.wantStatus, AuthenticationStatusCode(err), "err: %v", err)
+			if err == nil {
+				assert.Equal(t, AuthenticationPayload{ClientId: "app", UserName: "jane", UserId: "user-123", UserSid: "S-1-5-21-1001"}, a)
+			}
+		})
+	}
+	var id VerifiedIdentity
+	h := j.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ = VerifiedIdentityFromContext(r.Context())
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["azp"] = "app" })))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, VerifiedIdentity{ClientId: "app", UserName: "jane", UserId: "user-123", UserSid: "S-1-5-21-1001"}, id)
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	set, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "p384", "kty": "EC", "crv": "P-384", "x": "AAAA", "y": "AAAA"},
+		{"kid": "symmetric", "kty": "oct", "k": "AAAA"},
+		{"kid": "rsa", "kty": "RSA", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}})
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write(set)
+	}))
+	defer srv.Close()
+
+	j := NewJWKS(srv.URL, time.Hour)
+	logger, hook := test.NewNullLogger()
+	j.L = logger
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, err := j.Keys(context.Background(), "rsa")
+			assert.NoError(t, err)
+			assert.Len(t, keys, 1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "concurrent refreshes should share a single fetch")
+	assert.Len(t, hook.AllEntries(), 2, "unsupported keys should be logged")
+
+	_, err := j.Keys(context.Background(), "p384")
+	assert.True(t, errors.Is(err, ErrUnknownSigningKey))
+}
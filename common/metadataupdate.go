@@ -0,0 +1,227 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// The ActionType of queue-items holding deferred metadata-updates.
+const ActionUpdateMetadata = "UpdateMetadata"
+
+var (
+	ErrDeferUpdate         = errors.New("the update should be deferred")
+	ErrUpdatesNotSupported = errors.New("the connector does not support metadata-updates")
+	ErrNoPendingUpdate     = errors.New("no pending metadata-update")
+)
+
+// A field that changed, by its json-name, e.g. 'caseNumber'. Nested fields are compared as a whole.
+type MetadataChange struct {
+	Field    string
+	Previous json.RawMessage `json:",omitempty"`
+	Current  json.RawMessage `json:",omitempty"`
+}
+
+type MetadataDiff []MetadataChange
+
+func (d MetadataDiff) Changed(field string) bool {
+	for _, c := range d {
+		if c.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+type MetadataUpdate struct {
+	Previous metadata.UploadMetadata
+	Current  metadata.UploadMetadata
+	Diff     MetadataDiff
+}
+
+func metadataFields(um metadata.UploadMetadata) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(um)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	return fields, json.Unmarshal(b, &fields)
+}
+
+// Returns the fields that differ, sorted by name.
+func DiffUploadMetadata(previous, current metadata.UploadMetadata) (MetadataDiff, error) {
+	prev, err := metadataFields(previous)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode previous metadata: %w", err)
+	}
+	cur, err := metadataFields(current)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode current metadata: %w", err)
+	}
+	var diff MetadataDiff
+	for field, p := range prev {
+		if c := cur[field]; !bytes.Equal(p, c) {
+			diff = append(diff, MetadataChange{Field: field, Previous: p, Current: c})
+		}
+	}
+	for field, c := range cur {
+		if _, ok := prev[field]; !ok {
+			diff = append(diff, MetadataChange{Field: field, Current: c})
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Field < diff[j].Field })
+	return diff, nil
+}
+
+// Returns a MetadataUpdate with the diff computed.
+func NewMetadataUpdate(previous, current metadata.UploadMetadata) (MetadataUpdate, error) {
+	diff, err := DiffUploadMetadata(previous, current)
+	return MetadataUpdate{Previous: previous, Current: current, Diff: diff}, err
+}
+
+func pendingUpdateKey(uploadId string) string {
+	return "metadataupdate:" + uploadId
+}
+
+// Serializes the metadata-updates of each upload within the process.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	waiters int
+}
+
+var metadataUpdateLocks = &uploadLocks{locks: map[string]*uploadLock{}}
+
+// Locks the upload, and returns the function unlocking it.
+func (l *uploadLocks) lock(uploadId string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[uploadId]
+	if !ok {
+		lock = &uploadLock{}
+		l.locks[uploadId] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if lock.waiters--; lock.waiters == 0 {
+			delete(l.locks, uploadId)
+		}
+	}
+}
+
+// A deferred update, as stored in Persistence until the queue has handled it.
+type pendingMetadataUpdate struct {
+	Previous metadata.UploadMetadata
+	Current  metadata.UploadMetadata
+	Pending  bool
+}
+
+// Sends the update to the connector. Updates without changes are not sent.
+//
+// If the connector returns ErrDeferUpdate, the update is stored in Persistence and added to the queue with
+// ActionUpdateMetadata, and the result is UploadUpdateQueued. Further updates before the queue has handled it
+// are merged, so that the connector receives the metadata it already has as Previous.
+//
+// Updates of the same upload are serialized, along with HandleMetadataUpdateQueue.
+func ApplyMetadataUpdate(ctx context.Context, connector interface{}, connectorId string, p Persistence, q QueueStorer, info tusd.FileInfo, previous, current metadata.UploadMetadata) (UploadResult, error) {
+	u, ok := connector.(UploadMetadataUpdater)
+	if !ok {
+		return UploadResult{}, ErrUpdatesNotSupported
+	}
+	defer metadataUpdateLocks.lock(info.ID)()
+	var pending pendingMetadataUpdate
+	if _, err := p.Get(pendingUpdateKey(info.ID), &pending); err != nil {
+		return UploadResult{}, fmt.Errorf("failed to get pending metadata-update for '%s': %w", info.ID, err)
+	}
+	if pending.Pending {
+		pending.Current = current
+		if err := p.Set(pendingUpdateKey(info.ID), pending); err != nil {
+			return UploadResult{}, fmt.Errorf("failed to store pending metadata-update for '%s': %w", info.ID, err)
+		}
+		return UploadResult{Confirmed: UploadUpdateQueued}, nil
+	}
+	update, err := NewMetadataUpdate(previous, current)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if len(update.Diff) == 0 {
+		return UploadResult{}, nil
+	}
+	res, err := u.UpdateMetadata(ctx, info, update)
+	if !errors.Is(err, ErrDeferUpdate) {
+		return res, err
+	}
+	// Queued first, so that the update is never pending without a queue-item to send it.
+	// A queue-item without a pending update is completed with ErrNoPendingUpdate.
+	if err := q.AddToQueue(info.ID, connectorId, ActionUpdateMetadata, time.Now()); err != nil {
+		return UploadResult{}, fmt.Errorf("failed to queue metadata-update for '%s': %w", info.ID, err)
+	}
+	pending = pendingMetadataUpdate{Previous: previous, Current: current, Pending: true}
+	if err := p.Set(pendingUpdateKey(info.ID), pending); err != nil {
+		return UploadResult{}, fmt.Errorf("failed to store pending metadata-update for '%s': %w", info.ID, err)
+	}
+	return UploadResult{Confirmed: UploadUpdateQueued}, nil
+}
+
+// Handles a queue-item with ActionUpdateMetadata, by sending the pending update to the connector.
+// Should be called from QueueHandler.HandleQueue.
+//
+// The pending update is only cleared if it was not changed while it was sent, e.g. by another process.
+// Otherwise, the queue-item is kept, to send the rest of the changes.
+// If the connector defers the update again, the result is marked BackendUnavailable.
+func HandleMetadataUpdateQueue(ctx context.Context, u UploadMetadataUpdater, p Persistence, qi QueueItem) QueueRunResult {
+	defer metadataUpdateLocks.lock(qi.Info.ID)()
+	var pending pendingMetadataUpdate
+	if _, err := p.Get(pendingUpdateKey(qi.Info.ID), &pending); err != nil {
+		return QueueRunResult{Err: fmt.Sprintf("failed to get pending metadata-update: %s", err)}
+	}
+	if !pending.Pending {
+		return QueueRunResult{CompleteQueueItem: true, Err: ErrNoPendingUpdate.Error()}
+	}
+	update, err := NewMetadataUpdate(pending.Previous, pending.Current)
+	if err != nil {
+		return QueueRunResult{Err: err.Error()}
+	}
+	if len(update.Diff) > 0 {
+		if _, err := u.UpdateMetadata(ctx, qi.Info, update); err != nil {
+			return QueueRunResult{Err: err.Error(), BackendUnavailable: errors.Is(err, ErrDeferUpdate)}
+		}
+	}
+	var latest pendingMetadataUpdate
+	if _, err := p.Get(pendingUpdateKey(qi.Info.ID), &latest); err != nil {
+		return QueueRunResult{Err: fmt.Sprintf("failed to get pending metadata-update: %s", err)}
+	}
+	changed, err := DiffUploadMetadata(pending.Current, latest.Current)
+	if err != nil {
+		return QueueRunResult{Err: err.Error()}
+	}
+	if len(changed) > 0 {
+		// The connector now has the metadata that was sent
+		latest.Previous = pending.Current
+		if err := p.Set(pendingUpdateKey(qi.Info.ID), latest); err != nil {
+			return QueueRunResult{Err: fmt.Sprintf("failed to store pending metadata-update: %s", err)}
+		}
+		return QueueRunResult{}
+	}
+	if err := p.Set(pendingUpdateKey(qi.Info.ID), pendingMetadataUpdate{}); err != nil {
+		return QueueRunResult{Err: fmt.Sprintf("failed to clear pending metadata-update: %s", err)}
+	}
+	return QueueRunResult{CompleteQueueItem: true}
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+type recordingQueue struct {
+	added []QueueItem
+}
+
+func (q *recordingQueue) Complete(id string) error { return nil }
+func (q *recordingQueue) MarkErr(qi QueueItem, err string, postpone bool, backoff bool) error {
+	return nil
+}
+func (q *recordingQueue) Options() QueueOptions { return QueueOptions{} }
+func (q *recordingQueue) GetAll(o GetAllOptions) ([]QueueItem, bool, error) {
+	return q.added, len(q.added) > 0, nil
+}
+func (q *recordingQueue) AddToQueue(infoId, connectorId, actionType string, dueAt time.Time) error {
+	q.added = append(q.added, QueueItem{ConnectorId: connectorId, ActionType: actionType, Info: tusd.FileInfo{ID: infoId}, DueAt: dueAt})
+	return nil
+}
+func (q *recordingQueue) UpdateQueueItem(id string, dueAt sql.NullTime, attempts int, err string, backoff bool) error {
+	return nil
+}
+
+type updatingConnector struct {
+	updates []MetadataUpdate
+	err     error
+	// Called before the update is handled, if set
+	during func()
+}
+
+func (c *updatingConnector) UpdateMetadata(ctx context.Context, info tusd.FileInfo, update MetadataUpdate) (UploadResult, error) {
+	if c.during != nil {
+		c.during()
+	}
+	if c.err != nil {
+		return UploadResult{}, c.err
+	}
+	c.updates = append(c.updates, update)
+	return UploadResult{Confirmed: UploadConfirmedComplete, ExtId: "ext-" + info.ID}, nil
+}
+
+func TestDiffUploadMetadata(t *testing.T) {
+	previous := metadata.UploadMetadata{CaseNumber: "C1", DisplayName: "Interview", Tags: []string{"a"}}
+	current := metadata.UploadMetadata{CaseNumber: "C2", DisplayName: "Interview", Tags: []string{"a", "b"}}
+	diff, err := DiffUploadMetadata(previous, current)
+	assert.NoError(t, err)
+	assert.Len(t, diff, 2)
+	assert.Equal(t, "caseNumber", diff[0].Field)
+	assert.Equal(t, `"C1"`, string(diff[0].Previous))
+	assert.Equal(t, `"C2"`, string(diff[0].Current))
+	assert.True(t, diff.Changed("tags"))
+	assert.False(t, diff.Changed("displayName"))
+
+	diff, err = DiffUploadMetadata(previous, previous)
+	assert.NoError(t, err)
+	assert.Empty(t, diff)
+}
+
+func TestApplyMetadataUpdate(t *testing.T) {
+	p := newMemoryPersistence()
+	q := &recordingQueue{}
+	c := &updatingConnector{}
+	info := tusd.FileInfo{ID: "abc"}
+	v1 := metadata.UploadMetadata{CaseNumber: "C1"}
+	v2 := metadata.UploadMetadata{CaseNumber: "C2"}
+	v3 := metadata.UploadMetadata{CaseNumber: "C2", DisplayName: "Interview"}
+
+	_, err := ApplyMetadataUpdate(context.Background(), struct{}{}, "test", p, q, info, v1, v2)
+	assert.True(t, errors.Is(err, ErrUpdatesNotSupported))
+
+	res, err := ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v1, v2)
+	assert.NoError(t, err)
+	assert.Equal(t, "ext-abc", res.ExtId)
+	assert.Len(t, c.updates, 1)
+	assert.True(t, c.updates[0].Diff.Changed("caseNumber"))
+
+	// Unchanged metadata is not sent
+	_, err = ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v2, v2)
+	assert.NoError(t, err)
+	assert.Len(t, c.updates, 1)
+
+	// Deferred while the backend is down, and merged with later updates
+	c.err = ErrDeferUpdate
+	res, err = ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v1, v2)
+	assert.NoError(t, err)
+	assert.Equal(t, UploadUpdateQueued, res.Confirmed)
+	assert.Len(t, q.added, 1)
+	assert.Equal(t, ActionUpdateMetadata, q.added[0].ActionType)
+	res, err = ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v2, v3)
+	assert.NoError(t, err)
+	assert.Equal(t, UploadUpdateQueued, res.Confirmed)
+	assert.Len(t, q.added, 1)
+
+	// The queue retries until the backend is up
+	result := HandleMetadataUpdateQueue(context.Background(), c, p, q.added[0])
+	assert.False(t, result.CompleteQueueItem)
+	assert.NotEmpty(t, result.Err)
+
+	c.err = nil
+	result = HandleMetadataUpdateQueue(context.Background(), c, p, q.added[0])
+	assert.True(t, result.CompleteQueueItem)
+	assert.Empty(t, result.Err)
+	assert.Len(t, c.updates, 2)
+	assert.Equal(t, v1, c.updates[1].Previous)
+	assert.Equal(t, v3, c.updates[1].Current)
+	assert.True(t, c.updates[1].Diff.Changed("caseNumber"))
+	assert.True(t, c.updates[1].Diff.Changed("displayName"))
+
+	// Once handled, updates are sent directly again
+	_, err = ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v3, v1)
+	assert.NoError(t, err)
+	assert.Len(t, c.updates, 3)
+
+	result = HandleMetadataUpdateQueue(context.Background(), c, p, q.added[0])
+	assert.True(t, result.CompleteQueueItem)
+}
+
+func TestHandleMetadataUpdateQueue_Interleaved(t *testing.T) {
+	p := newMemoryPersistence()
+	q := &recordingQueue{}
+	c := &updatingConnector{err: ErrDeferUpdate}
+	info := tusd.FileInfo{ID: "abc"}
+	v1 := metadata.UploadMetadata{CaseNumber: "C1"}
+	v2 := metadata.UploadMetadata{CaseNumber: "C2"}
+	v3 := metadata.UploadMetadata{CaseNumber: "C2", DisplayName: "Interview"}
+	_, err := ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v1, v2)
+	assert.NoError(t, err)
+	// Deferred again, while the backend is still unavailable
+	result := HandleMetadataUpdateQueue(context.Background(), c, p, q.added[0])
+	assert.False(t, result.CompleteQueueItem)
+	assert.True(t, result.BackendUnavailable)
+	c.err = nil
+
+	// An update arriving while the queue is sending, waits for it, and is not lost
+	sending, release := make(chan struct{}), make(chan struct{})
+	c.during = func() {
+		c.during = nil
+		close(sending)
+		<-release
+	}
+	handled := make(chan QueueRunResult)
+	go func() { handled <- HandleMetadataUpdateQueue(context.Background(), c, p, q.added[0]) }()
+	<-sending
+	applied := make(chan error)
+	go func() {
+		_, err := ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v2, v3)
+		applied <- err
+	}()
+	select {
+	case <-applied:
+		t.Fatal("the update was applied while the queue was sending")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	assert.True(t, (<-handled).CompleteQueueItem)
+	assert.NoError(t, <-applied)
+	if assert.Len(t, c.updates, 2) {
+		assert.Equal(t, v2, c.updates[0].Current)
+		assert.Equal(t, v2, c.updates[1].Previous)
+		assert.Equal(t, v3, c.updates[1].Current)
+	}
+
+	// A pending update changed while it is sent, e.g. by another process, is kept for the rest
+	c.err = ErrDeferUpdate
+	_, err = ApplyMetadataUpdate(context.Background(), c, "test", p, q, info, v3, v1)
+	assert.NoError(t, err)
+	c.err = nil
+	c.during = func() {
+		c.during = nil
+		p.Set(pendingUpdateKey(info.ID), pendingMetadataUpdate{Previous: v3, Current: v2, Pending: true})
+	}
+	result = HandleMetadataUpdateQueue(context.Background(), c, p, q.added[1])
+	assert.False(t, result.CompleteQueueItem)
+	assert.Empty(t, result.Err)
+	result = HandleMetadataUpdateQueue(context.Background(), c, p, q.added[1])
+	assert.True(t, result.CompleteQueueItem)
+	if assert.Len(t, c.updates, 4) {
+		assert.Equal(t, v1, c.updates[2].Current)
+		assert.Equal(t, v1, c.updates[3].Previous)
+		assert.Equal(t, v2, c.updates[3].Current)
+	}
+}
+
+type failingQueue struct {
+	recordingQueue
+}
+
+func (q *failingQueue) AddToQueue(infoId, connectorId, actionType string, dueAt time.Time) error {
+	return errors.New("queue unavailable")
+}
+
+func TestApplyMetadataUpdate_QueueFailure(t *testing.T) {
+	p := newMemoryPersistence()
+	c := &updatingConnector{err: ErrDeferUpdate}
+	info := tusd.FileInfo{ID: "abc"}
+	v1 := metadata.UploadMetadata{CaseNumber: "C1"}
+	v2 := metadata.UploadMetadata{CaseNumber: "C2"}
+	_, err := ApplyMetadataUpdate(context.Background(), c, "test", p, &failingQueue{}, info, v1, v2)
+	assert.Error(t, err)
+
+	// Not left pending without a queue-item, so later updates are sent rather than merged
+	var pending pendingMetadataUpdate
+	p.Get(pendingUpdateKey(info.ID), &pending)
+	assert.False(t, pending.Pending)
+}
+
+func TestFeatureDocumentMetadataUpdates(t *testing.T) {
+	doc, err := NewFeatureDocument(&updatingConnector{})
+	assert.NoError(t, err)
+	assert.True(t, doc.MetadataUpdates)
+}
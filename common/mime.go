@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/indicosystems/proxy-common/metadata"
+)
+
+var (
+	ErrMimeMismatch = errors.New("the content of the file does not match the declared filetype")
+)
+
+// Mime-types that can be detected by SniffMime
+const (
+	MimeJpeg      = "image/jpeg"
+	MimePng       = "image/png"
+	MimeHeic      = "image/heic"
+	MimeMp4       = "video/mp4"
+	MimeQuicktime = "video/quicktime"
+	MimeM4a       = "audio/mp4"
+	MimeWav       = "audio/wav"
+	MimeMp3       = "audio/mpeg"
+	MimePdf       = "application/pdf"
+)
+
+var supportedMimes = map[string]bool{
+	MimeJpeg:      true,
+	MimePng:       true,
+	MimeHeic:      true,
+	MimeMp4:       true,
+	MimeQuicktime: true,
+	MimeM4a:       true,
+	MimeWav:       true,
+	MimeMp3:       true,
+	MimePdf:       true,
+}
+
+// Aliases commonly sent by clients, mapped to the types returned by SniffMime
+var mimeAliases = map[string]string{
+	"image/jpg":         MimeJpeg,
+	"image/pjpeg":       MimeJpeg,
+	"image/heif":        MimeHeic,
+	"image/heic":        MimeHeic,
+	"audio/m4a":         MimeM4a,
+	"audio/x-m4a":       MimeM4a,
+	"audio/aac":         MimeM4a,
+	"audio/x-wav":       MimeWav,
+	"audio/wave":        MimeWav,
+	"audio/vnd.wave":    MimeWav,
+	"audio/mp3":         MimeMp3,
+	"audio/x-mpeg":      MimeMp3,
+	"video/x-m4v":       MimeMp4,
+	"video/mov":         MimeQuicktime,
+	"application/x-pdf": MimePdf,
+}
+
+// ISO base media (ftyp) major brands
+var ftypBrands = map[string]string{
+	"isom": MimeMp4,
+	"iso2": MimeMp4,
+	"mp41": MimeMp4,
+	"mp42": MimeMp4,
+	"avc1": MimeMp4,
+	"M4V ": MimeMp4,
+	"dash": MimeMp4,
+	"qt  ": MimeQuicktime,
+	"M4A ": MimeM4a,
+	"M4B ": MimeM4a,
+	"heic": MimeHeic,
+	"heix": MimeHeic,
+	"hevc": MimeHeic,
+	"hevx": MimeHeic,
+	"heim": MimeHeic,
+	"heis": MimeHeic,
+	"mif1": MimeHeic,
+	"msf1": MimeHeic,
+}
+
+// Returns the mime-type detected from the magic bytes of the beginning of a file.
+// An empty string is returned if the type could not be detected.
+func SniffMime(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8, 0xFF}):
+		return MimeJpeg
+	case bytes.HasPrefix(b, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}):
+		return MimePng
+	case bytes.HasPrefix(b, []byte("%PDF-")):
+		return MimePdf
+	case len(b) >= 12 && bytes.Equal(b[0:4], []byte("RIFF")) && bytes.Equal(b[8:12], []byte("WAVE")):
+		return MimeWav
+	case bytes.HasPrefix(b, []byte("ID3")):
+		return MimeMp3
+	case len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0 && b[1]&0x06 != 0:
+		// MPEG audio frame-sync, with a valid layer
+		return MimeMp3
+	case len(b) >= 12 && bytes.Equal(b[4:8], []byte("ftyp")):
+		return ftypBrands[string(b[8:12])]
+	}
+	return ""
+}
+
+// Returns the canonical form of a mime-type, as returned by SniffMime
+func NormalizeMime(mime string) string {
+	mime = strings.ToLower(strings.TrimSpace(mime))
+	if i := strings.Index(mime, ";"); i >= 0 {
+		mime = strings.TrimSpace(mime[:i])
+	}
+	if alias, ok := mimeAliases[mime]; ok {
+		return alias
+	}
+	return mime
+}
+
+// Reports whether the declared mime-type is compatible with the detected one.
+func mimeCompatible(declared, detected string) bool {
+	if declared == detected {
+		return true
+	}
+	// Mp4 and Quicktime share the same container, and clients are not consistent in what they report.
+	switch {
+	case declared == MimeMp4 && detected == MimeQuicktime,
+		declared == MimeQuicktime && detected == MimeMp4:
+		return true
+	}
+	return false
+}
+
+// Verifies the declared UploadMetadata.FileType against the actual content of the file.
+type MimeVerifier struct {
+	// Reject uploads with mismatching content
+	Strict bool
+	// Localizes the ClientMessage. Defaults to the Localizer on the context, see LocalizerFromContext.
+	Localizer *Localizer
+}
+
+// Returns a MimeVerifier as configured by the options, or nil if VerifyMime is not enabled.
+func NewMimeVerifier(o S3ConfigOptions) *MimeVerifier {
+	if !o.VerifyMime {
+		return nil
+	}
+	return &MimeVerifier{Strict: o.StrictMime}
+}
+
+// Inspects the first chunk of an upload. Chunks at any other offset are ignored.
+//
+// A mismatch is recorded as a ClientMessage on the metadata. In strict-mode, ErrMimeMismatch is also returned.
+// Content that is not recognized, or filetypes that are not supported, are not considered a mismatch.
+func (v *MimeVerifier) VerifyChunk(ctx context.Context, data *metadata.Metadata, offset int64, chunk []byte) error {
+	if v == nil || offset != 0 {
+		return nil
+	}
+	declared := NormalizeMime(data.GetUploadMetadata().FileType)
+	if !supportedMimes[declared] {
+		return nil
+	}
+	detected := SniffMime(chunk)
+	if detected == "" {
+		return nil
+	}
+	if mimeCompatible(declared, detected) {
+		return nil
+	}
+	loc := LocalizerFromContext(ctx)
+	if v.Localizer != nil {
+		loc = *v.Localizer
+	}
+	data.AppendClientMessage(loc.ClientMessage(metadata.MimeMismatch, "MimeMismatch", Params{"declared": declared, "detected": detected}))
+	if v.Strict {
+		return fmt.Errorf("%w: declared '%s', detected '%s'", ErrMimeMismatch, declared, detected)
+	}
+	return nil
+}
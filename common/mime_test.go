@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffMime(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0x10, 'J', 'F', 'I', 'F'}, MimeJpeg},
+		{"png", []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n', 0, 0}, MimePng},
+		{"pdf", []byte("%PDF-1.7\n"), MimePdf},
+		{"wav", []byte("RIFF\x24\x08\x00\x00WAVEfmt "), MimeWav},
+		{"mp3 with id3", []byte("ID3\x04\x00\x00\x00\x00"), MimeMp3},
+		{"mp3 frame", []byte{0xFF, 0xFB, 0x90, 0x64}, MimeMp3},
+		{"mp4", []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), MimeMp4},
+		{"mov", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"), MimeQuicktime},
+		{"m4a", []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"), MimeM4a},
+		{"heic", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"), MimeHeic},
+		{"unknown", []byte("hello world"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SniffMime(tt.b))
+		})
+	}
+}
+
+func TestMimeVerifier_VerifyChunk(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+	mov := []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00")
+	tests := []struct {
+		name        string
+		strict      bool
+		fileType    string
+		offset      int64
+		chunk       []byte
+		wantErr     error
+		wantMessage bool
+	}{
+		{"matching", true, "image/png", 0, png, nil, false},
+		{"mismatch is reported", false, "image/jpeg", 0, png, nil, true},
+		{"mismatch is rejected in strict-mode", true, "image/jpeg", 0, png, ErrMimeMismatch, true},
+		{"aliases are accepted", true, "image/jpg", 0, []byte{0xFF, 0xD8, 0xFF, 0xE1}, nil, false},
+		{"mp4 and quicktime are compatible", true, "video/mp4", 0, mov, nil, false},
+		{"only the first chunk is inspected", true, "image/jpeg", 1024, png, nil, false},
+		{"unsupported declared types are ignored", true, "text/plain", 0, png, nil, false},
+		{"unknown content is ignored", true, "image/jpeg", 0, []byte("abc"), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := metadata.UploadMetadata{FileType: tt.fileType}.ConvertToMetaData()
+			v := &MimeVerifier{Strict: tt.strict}
+			err := v.VerifyChunk(context.Background(), &data, tt.offset, tt.chunk)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyChunk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.wantMessage, len(data.GetClientMessages()) > 0)
+		})
+	}
+
+	data := metadata.UploadMetadata{FileType: "image/jpeg"}.ConvertToMetaData()
+	nb := DefaultCatalog().Localizer("nb")
+	(&MimeVerifier{Localizer: &nb}).VerifyChunk(context.Background(), &data, 0, png)
+	assert.Equal(t, "Filen ble oppgitt som 'image/jpeg', men innholdet ble gjenkjent som 'image/png'", data.GetClientMessages()[0].Message)
+
+	data = metadata.UploadMetadata{FileType: "image/jpeg"}.ConvertToMetaData()
+	(&MimeVerifier{}).VerifyChunk(ContextWithLocalizer(context.Background(), nb), &data, 0, png)
+	assert.Equal(t, "Filen ble oppgitt som 'image/jpeg', men innholdet ble gjenkjent som 'image/png'", data.GetClientMessages()[0].Message)
+}
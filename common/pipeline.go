@@ -0,0 +1,238 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// The hooks an UploadPipeline wraps.
+const (
+	HookInitiate = "InitiateNewUpload"
+	HookComplete = "CompleteUpload"
+	// The name of the connector in StepTimings and UploadStepErrors
+	ConnectorStep = "connector"
+)
+
+// NewUploadInitiator as a function.
+type InitiateFunc func(ctx context.Context, data *metadata.Metadata) error
+
+func (f InitiateFunc) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	return f(ctx, data)
+}
+
+// UploadCompleter as a function.
+type CompleteFunc func(info tusd.FileInfo) (UploadResult, error)
+
+func (f CompleteFunc) CompleteUpload(info tusd.FileInfo) (UploadResult, error) {
+	return f(info)
+}
+
+// A step in an UploadPipeline. Either hook may be nil, in which case the step is skipped for that hook.
+//
+// A step calls next to continue the pipeline, or returns without calling it to short-circuit,
+// in which case neither later steps nor the connector are called.
+type UploadStep struct {
+	Name     string
+	Initiate func(ctx context.Context, data *metadata.Metadata, next InitiateFunc) error
+	Complete func(info tusd.FileInfo, next CompleteFunc) (UploadResult, error)
+}
+
+// Returns a step from a decorator of NewUploadInitiator, like QuotaUploadInitiator.
+func InitiatorStep(name string, wrap func(next NewUploadInitiator) NewUploadInitiator) UploadStep {
+	return UploadStep{
+		Name: name,
+		Initiate: func(ctx context.Context, data *metadata.Metadata, next InitiateFunc) error {
+			return wrap(next).InitiateNewUpload(ctx, data)
+		},
+	}
+}
+
+// Returns a step from a decorator of UploadCompleter, like QuotaUploadCompleter.
+func CompleterStep(name string, wrap func(next UploadCompleter) UploadCompleter) UploadStep {
+	return UploadStep{
+		Name: name,
+		Complete: func(info tusd.FileInfo, next CompleteFunc) (UploadResult, error) {
+			return wrap(next).CompleteUpload(info)
+		},
+	}
+}
+
+// The time spent in a step, excluding the time spent in later steps.
+type StepTiming struct {
+	Hook     string
+	Step     string
+	Duration time.Duration
+	Err      error
+}
+
+// Returned when a step, or the connector, fails. Wraps the error of the step that failed.
+//
+// Implements tusd.HTTPError, as tusd does not unwrap errors to find the status-code. The status-code and body
+// are those of the wrapped error, if it is a tusd.HTTPError or *LimitError, and 500 and the message otherwise.
+type UploadStepError struct {
+	Hook string
+	Step string
+	Err  error
+}
+
+func (e *UploadStepError) Error() string {
+	return fmt.Sprintf("%s failed in step '%s': %s", e.Hook, e.Step, e.Err)
+}
+
+func (e *UploadStepError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UploadStepError) StatusCode() int {
+	var httpErr tusd.HTTPError
+	if errors.As(e.Err, &httpErr) {
+		return httpErr.StatusCode()
+	}
+	var limitErr *LimitError
+	if errors.As(e.Err, &limitErr) {
+		return limitErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+func (e *UploadStepError) Body() []byte {
+	var httpErr tusd.HTTPError
+	if errors.As(e.Err, &httpErr) {
+		return httpErr.Body()
+	}
+	var limitErr *LimitError
+	if errors.As(e.Err, &limitErr) {
+		return []byte(limitErr.Error())
+	}
+	return []byte(e.Error())
+}
+
+// Sets the Retry-After-header of a wrapped *LimitError. tusd does not set headers from errors, so this is for
+// handlers that write the error themselves.
+func (e *UploadStepError) SetHeaders(w http.ResponseWriter) {
+	var limitErr *LimitError
+	if errors.As(e.Err, &limitErr) {
+		limitErr.SetHeaders(w)
+	}
+}
+
+// Wraps the error with the step, unless it already is wrapped by a later step.
+func wrapStepError(hook, step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var stepErr *UploadStepError
+	if errors.As(err, &stepErr) {
+		return err
+	}
+	return &UploadStepError{Hook: hook, Step: step, Err: err}
+}
+
+// Ordered steps around the InitiateNewUpload and CompleteUpload of a connector.
+// The first step is the outermost, and is called first.
+type UploadPipeline struct {
+	Initiator NewUploadInitiator
+	Completer UploadCompleter
+	Steps     []UploadStep
+	// Called with the timing of every step, and of the connector, if set.
+	OnTiming func(StepTiming)
+}
+
+// Returns a pipeline around the connector, which should implement NewUploadInitiator and/or UploadCompleter.
+func NewUploadPipeline(connector interface{}, steps ...UploadStep) *UploadPipeline {
+	p := &UploadPipeline{Steps: steps}
+	p.Initiator, _ = connector.(NewUploadInitiator)
+	p.Completer, _ = connector.(UploadCompleter)
+	return p
+}
+
+// Appends steps to the pipeline. Not safe to call while uploads are in progress.
+func (p *UploadPipeline) Use(steps ...UploadStep) {
+	p.Steps = append(p.Steps, steps...)
+}
+
+// Measures the time spent in a step, excluding the time spent in next.
+type stepTimer struct {
+	hook, step string
+	start      time.Time
+	inner      time.Duration
+}
+
+func (p *UploadPipeline) report(t *stepTimer, err error) {
+	if p.OnTiming != nil {
+		p.OnTiming(StepTiming{Hook: t.hook, Step: t.step, Duration: time.Since(t.start) - t.inner, Err: err})
+	}
+}
+
+func (p *UploadPipeline) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	return p.initiate(0)(ctx, data)
+}
+
+func (p *UploadPipeline) initiate(i int) InitiateFunc {
+	for ; i < len(p.Steps) && p.Steps[i].Initiate == nil; i++ {
+	}
+	if i == len(p.Steps) {
+		return func(ctx context.Context, data *metadata.Metadata) error {
+			t := &stepTimer{hook: HookInitiate, step: ConnectorStep, start: time.Now()}
+			var err error
+			if p.Initiator != nil {
+				err = p.Initiator.InitiateNewUpload(ctx, data)
+			}
+			p.report(t, err)
+			return wrapStepError(HookInitiate, ConnectorStep, err)
+		}
+	}
+	step := p.Steps[i]
+	return func(ctx context.Context, data *metadata.Metadata) error {
+		t := &stepTimer{hook: HookInitiate, step: step.Name, start: time.Now()}
+		next := p.initiate(i + 1)
+		err := step.Initiate(ctx, data, func(ctx context.Context, data *metadata.Metadata) error {
+			start := time.Now()
+			defer func() { t.inner += time.Since(start) }()
+			return next(ctx, data)
+		})
+		p.report(t, err)
+		return wrapStepError(HookInitiate, step.Name, err)
+	}
+}
+
+func (p *UploadPipeline) CompleteUpload(info tusd.FileInfo) (UploadResult, error) {
+	return p.complete(0)(info)
+}
+
+func (p *UploadPipeline) complete(i int) CompleteFunc {
+	for ; i < len(p.Steps) && p.Steps[i].Complete == nil; i++ {
+	}
+	if i == len(p.Steps) {
+		return func(info tusd.FileInfo) (UploadResult, error) {
+			t := &stepTimer{hook: HookComplete, step: ConnectorStep, start: time.Now()}
+			var (
+				res UploadResult
+				err error
+			)
+			if p.Completer != nil {
+				res, err = p.Completer.CompleteUpload(info)
+			}
+			p.report(t, err)
+			return res, wrapStepError(HookComplete, ConnectorStep, err)
+		}
+	}
+	step := p.Steps[i]
+	return func(info tusd.FileInfo) (UploadResult, error) {
+		t := &stepTimer{hook: HookComplete, step: step.Name, start: time.Now()}
+		next := p.complete(i + 1)
+		res, err := step.Complete(info, func(info tusd.FileInfo) (UploadResult, error) {
+			start := time.Now()
+			defer func() { t.inner += time.Since(start) }()
+			return next(info)
+		})
+		p.report(t, err)
+		return res, wrapStepError(HookComplete, step.Name, err)
+	}
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+type recordingConnector struct {
+	calls []string
+	err   error
+}
+
+func (c *recordingConnector) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	c.calls = append(c.calls, "initiate "+data.GetUploadMetadata().DisplayName)
+	return c.err
+}
+func (c *recordingConnector) CompleteUpload(info tusd.FileInfo) (UploadResult, error) {
+	c.calls = append(c.calls, "complete")
+	return UploadResult{ExtId: "ext-" + info.ID}, c.err
+}
+
+func TestUploadPipeline(t *testing.T) {
+	c := &recordingConnector{}
+	var timings []StepTiming
+	p := NewUploadPipeline(c,
+		UploadStep{
+			Name: "normalize",
+			Initiate: func(ctx context.Context, data *metadata.Metadata, next InitiateFunc) error {
+				c.calls = append(c.calls, "normalize")
+				um := data.GetUploadMetadata()
+				um.DisplayName = "normalized"
+				*data = um.ConvertToMetaData()
+				return next(ctx, data)
+			},
+		},
+		UploadStep{
+			Name: "slow",
+			Initiate: func(ctx context.Context, data *metadata.Metadata, next InitiateFunc) error {
+				time.Sleep(20 * time.Millisecond)
+				return next(ctx, data)
+			},
+			Complete: func(info tusd.FileInfo, next CompleteFunc) (UploadResult, error) {
+				res, err := next(info)
+				res.CaseId = "enriched"
+				return res, err
+			},
+		},
+	)
+	p.OnTiming = func(st StepTiming) { timings = append(timings, st) }
+
+	data := metadata.UploadMetadata{DisplayName: "raw"}.ConvertToMetaData()
+	assert.NoError(t, p.InitiateNewUpload(context.Background(), &data))
+	assert.Equal(t, []string{"normalize", "initiate normalized"}, c.calls)
+	assert.Len(t, timings, 3)
+	assert.Equal(t, ConnectorStep, timings[0].Step)
+	assert.Equal(t, "slow", timings[1].Step)
+	assert.Equal(t, "normalize", timings[2].Step)
+	assert.True(t, timings[1].Duration >= 20*time.Millisecond)
+	// The time of later steps is not counted
+	assert.True(t, timings[2].Duration < 20*time.Millisecond, timings[2].Duration)
+
+	res, err := p.CompleteUpload(tusd.FileInfo{ID: "abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, UploadResult{ExtId: "ext-abc", CaseId: "enriched"}, res)
+
+	// Errors are wrapped with the step they occurred in
+	c.err = errors.New("backend down")
+	err = p.InitiateNewUpload(context.Background(), &data)
+	var stepErr *UploadStepError
+	assert.True(t, errors.As(err, &stepErr))
+	assert.Equal(t, ConnectorStep, stepErr.Step)
+	assert.Equal(t, HookInitiate, stepErr.Hook)
+	assert.True(t, errors.Is(err, c.err))
+}
+
+func TestUploadPipelineShortCircuit(t *testing.T) {
+	c := &recordingConnector{}
+	errPII := errors.New("contains a national identity number")
+	p := NewUploadPipeline(c,
+		UploadStep{
+			Name: "pii",
+			Initiate: func(ctx context.Context, data *metadata.Metadata, next InitiateFunc) error {
+				if data.GetUploadMetadata().DisplayName == "12345678901" {
+					return errPII
+				}
+				return next(ctx, data)
+			},
+			Complete: func(info tusd.FileInfo, next CompleteFunc) (UploadResult, error) {
+				return UploadResult{ExtId: "cached"}, nil
+			},
+		},
+		InitiatorStep("features", func(next NewUploadInitiator) NewUploadInitiator {
+			return FeatureCheckedUploadInitiator{next, ConnectorFeatures{MaxFileSize: 10}}
+		}),
+	)
+
+	data := metadata.UploadMetadata{DisplayName: "12345678901"}.ConvertToMetaData()
+	err := p.InitiateNewUpload(context.Background(), &data)
+	var stepErr *UploadStepError
+	assert.True(t, errors.As(err, &stepErr))
+	assert.Equal(t, "pii", stepErr.Step)
+	assert.True(t, errors.Is(err, errPII))
+
+	data = metadata.UploadMetadata{FileSize: 11}.ConvertToMetaData()
+	err = p.InitiateNewUpload(context.Background(), &data)
+	assert.True(t, errors.As(err, &stepErr))
+	assert.Equal(t, "features", stepErr.Step)
+	assert.True(t, errors.Is(err, ErrFileTooLarge))
+	// tusd finds the status-code with a type-assertion, without unwrapping
+	if httpErr, ok := err.(tusd.HTTPError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, httpErr.StatusCode())
+		assert.Contains(t, string(httpErr.Body()), "the file is too large")
+	}
+	data = metadata.UploadMetadata{DisplayName: "12345678901"}.ConvertToMetaData()
+	err = p.InitiateNewUpload(context.Background(), &data)
+	assert.Equal(t, http.StatusInternalServerError, err.(tusd.HTTPError).StatusCode())
+
+	res, err := p.CompleteUpload(tusd.FileInfo{ID: "abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", res.ExtId)
+	assert.Empty(t, c.calls)
+}
+
+func TestUploadPipeline_LimitError(t *testing.T) {
+	c := &recordingConnector{}
+	tracker := NewQuotaTracker(newMemoryPersistence(), Quota{}, Quota{ConcurrentUploads: 1})
+	p := NewUploadPipeline(c, InitiatorStep("quota", func(next NewUploadInitiator) NewUploadInitiator {
+		return QuotaUploadInitiator{next, tracker}
+	}))
+	ctx := ContextWithVerifiedIdentity(context.Background(), VerifiedIdentity{ClientId: "app", UserId: "jane"})
+
+	data := metadata.UploadMetadata{DisplayName: "first"}.ConvertToMetaData()
+	assert.NoError(t, p.InitiateNewUpload(ctx, &data))
+	data = metadata.UploadMetadata{DisplayName: "second"}.ConvertToMetaData()
+	err := p.InitiateNewUpload(ctx, &data)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	if httpErr, ok := err.(tusd.HTTPError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusTooManyRequests, httpErr.StatusCode())
+		assert.Equal(t, "quota exceeded: No more than 1 upload can be in progress at the same time", string(httpErr.Body()))
+	}
+	assert.Equal(t, []string{"initiate first"}, c.calls)
+
+	w := httptest.NewRecorder()
+	(&UploadStepError{Err: newRateLimitError(1500 * time.Millisecond)}).SetHeaders(w)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestCompleterStep(t *testing.T) {
+	c := &recordingConnector{}
+	tracker := NewQuotaTracker(newMemoryPersistence(), Quota{}, Quota{ConcurrentUploads: 1})
+	p := NewUploadPipeline(c, CompleterStep("quota", func(next UploadCompleter) UploadCompleter {
+		return QuotaUploadCompleter{next, tracker}
+	}))
+	res, err := p.CompleteUpload(tusd.FileInfo{ID: "abc", MetaData: tusd.MetaData(metadata.UploadMetadata{}.ConvertToMetaData())})
+	assert.NoError(t, err)
+	assert.Equal(t, "ext-abc", res.ExtId)
+	assert.Equal(t, []string{"complete"}, c.calls)
+}
@@ -0,0 +1,527 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+var (
+	ErrNoReservation = errors.New("no quota-reservation")
+	// Returned to tusd when the body of a PATCH-request exceeds the quota
+	errQuotaBodyExceeded = tusd.NewHTTPError(ErrQuotaExceeded, http.StatusTooManyRequests)
+)
+
+type Quota struct {
+	// The number of bytes that can be uploaded per day (UTC). Zero means unlimited.
+	BytesPerDay int64
+	// The number of uploads that can be in progress at the same time. Zero means unlimited.
+	ConcurrentUploads int
+	// Uploads that have been in progress for longer than this are no longer counted. Defaults to 24 hours.
+	ActiveTimeout time.Duration
+}
+
+// The usage of an identity or user, as stored in Persistence.
+type QuotaUsage struct {
+	Day   string
+	Bytes int64
+	// Uploads in progress, with the time they were started
+	Active map[string]time.Time
+}
+
+// Tracks storage-quotas in Persistence, per verified identity, and per user it acts as.
+type QuotaTracker struct {
+	// The quota per VerifiedIdentity, shared by all the users the client acts as, see IdentityLimitKey
+	ClientQuota Quota
+	// The quota per user, see RateLimitKey
+	Quota Quota
+	p     Persistence
+	mu    sync.Mutex
+	now   func() time.Time
+}
+
+func NewQuotaTracker(p Persistence, client, user Quota) *QuotaTracker {
+	if client.ActiveTimeout <= 0 {
+		client.ActiveTimeout = 24 * time.Hour
+	}
+	if user.ActiveTimeout <= 0 {
+		user.ActiveTimeout = 24 * time.Hour
+	}
+	return &QuotaTracker{ClientQuota: client, Quota: user, p: p, now: time.Now}
+}
+
+// A quota, and the key its usage is stored under.
+type quotaLimit struct {
+	key   string
+	quota Quota
+}
+
+func (q *QuotaTracker) clientLimit(key string) quotaLimit {
+	return quotaLimit{"quotaclient:" + key, q.ClientQuota}
+}
+
+func (q *QuotaTracker) userLimit(key string) quotaLimit {
+	return quotaLimit{"quota:" + key, q.Quota}
+}
+
+// Returns the current usage of the user-key, as returned by RateLimitKey.
+func (q *QuotaTracker) Usage(key string) (QuotaUsage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage(q.userLimit(key))
+}
+
+// Returns the current usage of the identity-key, as returned by IdentityLimitKey.
+func (q *QuotaTracker) ClientUsage(key string) (QuotaUsage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage(q.clientLimit(key))
+}
+
+func (q *QuotaTracker) usage(l quotaLimit) (QuotaUsage, error) {
+	var u QuotaUsage
+	if _, err := q.p.Get(l.key, &u); err != nil {
+		return u, fmt.Errorf("failed to get quota-usage for '%s': %w", l.key, err)
+	}
+	now := q.now()
+	if day := now.UTC().Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.Bytes = 0
+	}
+	if u.Active == nil {
+		u.Active = map[string]time.Time{}
+	}
+	for id, started := range u.Active {
+		if now.Sub(started) > l.quota.ActiveTimeout {
+			delete(u.Active, id)
+		}
+	}
+	return u, nil
+}
+
+// Returns the usage of each of the limits, in the same order.
+func (q *QuotaTracker) usages(limits []quotaLimit) ([]QuotaUsage, error) {
+	usages := make([]QuotaUsage, len(limits))
+	for i, l := range limits {
+		u, err := q.usage(l)
+		if err != nil {
+			return nil, err
+		}
+		usages[i] = u
+	}
+	return usages, nil
+}
+
+func (q *QuotaTracker) storeUsages(limits []quotaLimit, usages []QuotaUsage) error {
+	for i, l := range limits {
+		if err := q.p.Set(l.key, usages[i]); err != nil {
+			return fmt.Errorf("failed to store quota-usage for '%s': %w", l.key, err)
+		}
+	}
+	return nil
+}
+
+func quotaReservationKey(uploadId string) string {
+	return "quotaupload:" + uploadId
+}
+
+// A reservation of quota, as stored in Persistence under the upload-id generated by Reserve.
+type quotaReservation struct {
+	ClientKey string
+	Key       string
+}
+
+func (q *QuotaTracker) limits(r quotaReservation) []quotaLimit {
+	return []quotaLimit{q.clientLimit(r.ClientKey), q.userLimit(r.Key)}
+}
+
+// Reserves quota for an upload, for the identity-key and the user-key, and returns the id generated for it.
+// Returns a *LimitError wrapping ErrQuotaExceeded if too many uploads are in progress, or if the declared size
+// would exceed either quota. The declared size is only used to reject uploads early, as the bytes counted are those
+// actually received, see AddBytes.
+func (q *QuotaTracker) Reserve(clientKey, key string, declaredSize int64) (string, error) {
+	uploadId, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r := quotaReservation{ClientKey: clientKey, Key: key}
+	limits := q.limits(r)
+	usages, err := q.usages(limits)
+	if err != nil {
+		return "", err
+	}
+	for i, l := range limits {
+		if l.quota.ConcurrentUploads > 0 && len(usages[i].Active) >= l.quota.ConcurrentUploads {
+			return "", newQuotaError("concurrentUploads", "QuotaExceeded.ConcurrentUploads", int64(l.quota.ConcurrentUploads), 0)
+		}
+		if l.quota.BytesPerDay > 0 && usages[i].Bytes+declaredSize > l.quota.BytesPerDay {
+			return "", q.bytesExceeded(l.quota)
+		}
+	}
+	for i := range usages {
+		usages[i].Active[uploadId] = q.now()
+	}
+	if err := q.p.Set(quotaReservationKey(uploadId), r); err != nil {
+		return "", fmt.Errorf("failed to store quota-reservation for '%s': %w", key, err)
+	}
+	if err := q.storeUsages(limits, usages); err != nil {
+		return "", err
+	}
+	return uploadId, nil
+}
+
+func (q *QuotaTracker) bytesExceeded(quota Quota) *LimitError {
+	tomorrow := q.now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	return newQuotaError("bytesPerDay", "QuotaExceeded.BytesPerDay", quota.BytesPerDay, tomorrow.Sub(q.now()))
+}
+
+// Reports whether any of the quotas limit the bytes per day.
+func (q *QuotaTracker) limitsBytes() bool {
+	return q.ClientQuota.BytesPerDay > 0 || q.Quota.BytesPerDay > 0
+}
+
+func (q *QuotaTracker) reservation(uploadId string) (quotaReservation, error) {
+	var r quotaReservation
+	found, err := q.p.Get(quotaReservationKey(uploadId), &r)
+	if err != nil {
+		return r, fmt.Errorf("failed to get quota-reservation '%s': %w", uploadId, err)
+	}
+	if !found || (r.Key == "" && r.ClientKey == "") {
+		return r, fmt.Errorf("%w: '%s'", ErrNoReservation, uploadId)
+	}
+	return r, nil
+}
+
+// Returns the number of bytes the upload may still receive today, within both quotas, or -1 if unlimited.
+func (q *QuotaTracker) Remaining(uploadId string) (int64, error) {
+	if !q.limitsBytes() {
+		return -1, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r, err := q.reservation(uploadId)
+	if err != nil {
+		return 0, err
+	}
+	limits := q.limits(r)
+	usages, err := q.usages(limits)
+	if err != nil {
+		return 0, err
+	}
+	remaining := int64(-1)
+	for i, l := range limits {
+		if l.quota.BytesPerDay <= 0 {
+			continue
+		}
+		left := l.quota.BytesPerDay - usages[i].Bytes
+		if left <= 0 {
+			return 0, q.bytesExceeded(l.quota)
+		}
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	return remaining, nil
+}
+
+// Counts bytes received for the upload against the quotas of its reservation.
+func (q *QuotaTracker) AddBytes(uploadId string, n int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.addBytes(uploadId, n)
+}
+
+func (q *QuotaTracker) addBytes(uploadId string, n int64) error {
+	r, err := q.reservation(uploadId)
+	if err != nil {
+		return err
+	}
+	limits := q.limits(r)
+	usages, err := q.usages(limits)
+	if err != nil {
+		return err
+	}
+	for i := range usages {
+		usages[i].Bytes += n
+		if usages[i].Bytes < 0 {
+			usages[i].Bytes = 0
+		}
+	}
+	return q.storeUsages(limits, usages)
+}
+
+// Counts up to n bytes for the upload, as far as the quotas allow, and returns the number counted. If partial is
+// false, either all n bytes are counted or none. Returns a *LimitError wrapping ErrQuotaExceeded if no bytes, or
+// with partial false not all of them, could be counted.
+//
+// Bytes are counted before they are received, so that concurrent requests cannot exceed the quota together.
+// Bytes counted but not received must be given back with AddBytes and a negative n.
+func (q *QuotaTracker) take(uploadId string, n int64, partial bool) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r, err := q.reservation(uploadId)
+	if err != nil {
+		return 0, err
+	}
+	limits := q.limits(r)
+	usages, err := q.usages(limits)
+	if err != nil {
+		return 0, err
+	}
+	granted := n
+	for i, l := range limits {
+		if l.quota.BytesPerDay <= 0 {
+			continue
+		}
+		left := l.quota.BytesPerDay - usages[i].Bytes
+		if left <= 0 || (!partial && left < n) {
+			return 0, q.bytesExceeded(l.quota)
+		}
+		if left < granted {
+			granted = left
+		}
+	}
+	for i := range usages {
+		usages[i].Bytes += granted
+	}
+	if err := q.storeUsages(limits, usages); err != nil {
+		return 0, err
+	}
+	return granted, nil
+}
+
+// Releases the upload from the concurrent uploads. The bytes are still counted for the day.
+func (q *QuotaTracker) Release(uploadId string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r, err := q.reservation(uploadId)
+	if err != nil {
+		return err
+	}
+	limits := q.limits(r)
+	usages, err := q.usages(limits)
+	if err != nil {
+		return err
+	}
+	for i := range usages {
+		delete(usages[i].Active, uploadId)
+	}
+	if err := q.storeUsages(limits, usages); err != nil {
+		return err
+	}
+	if err := q.p.Set(quotaReservationKey(uploadId), quotaReservation{}); err != nil {
+		return fmt.Errorf("failed to clear quota-reservation '%s': %w", uploadId, err)
+	}
+	return nil
+}
+
+// The subtitle is the plural-form of messageKey for the limit, and the detail is keyed by messageKey + ".Limit".
+func newQuotaError(rawKey, messageKey string, limit int64, retryAfter time.Duration) *LimitError {
+	return newLimitError(ErrQuotaExceeded, retryAfter, func(loc Localizer) ValidationErrorResponse {
+		res := loc.ValidationError("QuotaExceeded", http.StatusTooManyRequests, "QuotaExceeded.Title", "", nil,
+			Localizable{RawKey: rawKey, RawValue: strconv.FormatInt(limit, 10)}.Localized(loc, messageKey+".Limit", "", nil))
+		res.Subtitle = loc.Plural(messageKey, int(limit), nil)
+		return res
+	})
+}
+
+// NewUploadInitiator that reserves quota for the upload, for the VerifiedIdentity on the context, and for the user
+// of the AuthenticationPayload it acts as.
+// The id of the reservation is written onto the metadata, for QuotaUploadCompleter and QuotaByteCounter.
+type QuotaUploadInitiator struct {
+	NewUploadInitiator
+	Tracker *QuotaTracker
+}
+
+func (u QuotaUploadInitiator) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	identity, _ := VerifiedIdentityFromContext(ctx)
+	a, _ := AuthenticationPayloadFromContext(ctx)
+	size := data.GetUploadMetadata().FileSize
+	if size < 0 {
+		size = 0
+	}
+	id, err := u.Tracker.Reserve(IdentityLimitKey(identity), RateLimitKey(identity, a), size)
+	if err != nil {
+		return localizeLimitError(err, LocalizerFromContext(ctx))
+	}
+	// Replaces any id sent by the client
+	data.SetRaw(metadata.QuotaUploadId, id)
+	if err := u.NewUploadInitiator.InitiateNewUpload(ctx, data); err != nil {
+		u.Tracker.Release(id)
+		return err
+	}
+	return nil
+}
+
+// UploadCompleter that releases the upload from the concurrent uploads.
+type QuotaUploadCompleter struct {
+	UploadCompleter
+	Tracker *QuotaTracker
+}
+
+func (u QuotaUploadCompleter) CompleteUpload(info tusd.FileInfo) (UploadResult, error) {
+	data := metadata.Metadata(info.MetaData)
+	res, err := u.UploadCompleter.CompleteUpload(info)
+	id := data.GetRaw(metadata.QuotaUploadId)
+	if id == "" {
+		return res, err
+	}
+	if releaseErr := u.Tracker.Release(id); releaseErr != nil && err == nil {
+		return res, releaseErr
+	}
+	return res, err
+}
+
+// Counts the bytes received in PATCH-requests against the daily quotas of the upload's reservation.
+//
+// The bytes are counted before they are read, so that concurrent requests cannot exceed the quota together, and
+// bytes that were not received are given back afterwards. Requests with a Content-Length above the remaining quota
+// are rejected, and bodies without one are counted in blocks, and cut off when the quota is reached.
+type QuotaByteCounter struct {
+	Tracker *QuotaTracker
+	// Returns the upload the request is for.
+	Lookup func(r *http.Request) (tusd.FileInfo, error)
+}
+
+// Returns a counter looking up uploads in the store, by the last segment of the request-path, as tusd does.
+func NewQuotaByteCounter(t *QuotaTracker, store tusd.DataStore) *QuotaByteCounter {
+	return &QuotaByteCounter{Tracker: t, Lookup: lookupUpload(store)}
+}
+
+func (c *QuotaByteCounter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, err := c.Lookup(r)
+		if err != nil {
+			// Left to tusd to reject
+			next.ServeHTTP(w, r)
+			return
+		}
+		data := metadata.Metadata(info.MetaData)
+		id := data.GetRaw(metadata.QuotaUploadId)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !c.Tracker.limitsBytes() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := &quotaBody{r: r.Body, tracker: c.Tracker, uploadId: id}
+		if r.ContentLength >= 0 {
+			granted, err := c.Tracker.take(id, r.ContentLength, false)
+			if err != nil {
+				writeLimitError(w, localizeLimitError(err, LocalizerFromRequest(r)))
+				return
+			}
+			body.granted, body.fixed = granted, true
+		}
+		r.Body = body
+		next.ServeHTTP(w, r)
+		// The response is already written, so the bytes not received can only be given back
+		if unused := body.granted - body.n; unused > 0 {
+			c.Tracker.AddBytes(id, -unused)
+		}
+	})
+}
+
+// The number of bytes counted at a time for bodies without a Content-Length.
+const quotaBlockSize = 1 << 20
+
+// Counts the bytes against the quota before they are read, and fails with errQuotaBodyExceeded when the quota is
+// reached.
+type quotaBody struct {
+	r        io.ReadCloser
+	tracker  *QuotaTracker
+	uploadId string
+	// The bytes counted, and the bytes read
+	granted, n int64
+	// Set if the bytes were counted by the Content-Length, so that no more are counted
+	fixed bool
+}
+
+func (q *quotaBody) Read(p []byte) (int, error) {
+	if q.n >= q.granted {
+		var (
+			granted int64
+			err     = ErrQuotaExceeded
+		)
+		if !q.fixed {
+			granted, err = q.tracker.take(q.uploadId, quotaBlockSize, true)
+		}
+		if err != nil {
+			// The body may end exactly at the quota
+			if n, readErr := q.r.Read(make([]byte, 1)); n == 0 && readErr != nil {
+				return 0, readErr
+			}
+			if errors.Is(err, ErrQuotaExceeded) {
+				return 0, errQuotaBodyExceeded
+			}
+			return 0, err
+		}
+		q.granted += granted
+	}
+	if left := q.granted - q.n; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := q.r.Read(p)
+	q.n += int64(n)
+	return n, err
+}
+
+func (q *quotaBody) Close() error {
+	return q.r.Close()
+}
+
+func writeLimitError(w http.ResponseWriter, err error) {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		limitErr.SetHeaders(w)
+		err = tusd.NewHTTPError(err, limitErr.StatusCode)
+	}
+	writeTusError(w, err)
+}
+
+// Counts the bytes read, and fails with exceeded when more than remaining bytes are read.
+// A negative remaining is unlimited.
+type limitedBody struct {
+	r         io.ReadCloser
+	remaining int64
+	exceeded  error
+	n         int64
+}
+
+func (q *limitedBody) Read(p []byte) (int, error) {
+	if q.remaining >= 0 {
+		if q.n >= q.remaining {
+			// The body may end exactly at the quota
+			if n, err := q.r.Read(make([]byte, 1)); n == 0 && err != nil {
+				return 0, err
+			}
+			return 0, q.exceeded
+		}
+		if left := q.remaining - q.n; int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := q.r.Read(p)
+	q.n += int64(n)
+	return n, err
+}
+
+func (q *limitedBody) Close() error {
+	return q.r.Close()
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+	"github.com/stretchr/testify/assert"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	now := time.Date(2021, 5, 12, 12, 0, 0, 0, time.UTC)
+	q := NewQuotaTracker(newMemoryPersistence(), Quota{BytesPerDay: 150, ConcurrentUploads: 2}, Quota{BytesPerDay: 100, ConcurrentUploads: 2})
+	q.now = func() time.Time { return now }
+
+	a, err := q.Reserve("app/", "app//jane", 40)
+	assert.NoError(t, err)
+	b, err := q.Reserve("app/", "app//jane", 0)
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, b, "ids are generated per reservation")
+	_, err = q.Reserve("app/", "app//jane", 10)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded), "concurrent uploads")
+	assert.NoError(t, q.Release(a))
+	_, err = q.Reserve("app/", "app//jane", 101)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded), "the declared size is above the quota")
+
+	// Only the bytes received are counted, whatever size was declared
+	assert.NoError(t, q.AddBytes(b, 90))
+	remaining, err := q.Remaining(b)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), remaining)
+	assert.NoError(t, q.AddBytes(b, 10))
+	_, err = q.Remaining(b)
+	var limitErr *LimitError
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, 12*time.Hour, limitErr.RetryAfter)
+		assert.Equal(t, "The daily limit of 100 bytes would be exceeded", limitErr.Subtitle)
+		assert.Equal(t, "Bytes per day", limitErr.Details[0].Key)
+	}
+	assert.True(t, errors.Is(q.Release("unknown"), ErrNoReservation))
+
+	// Other users of the client share the quota of the client
+	john, err := q.Reserve("app/", "app//john", 0)
+	assert.NoError(t, err)
+	remaining, err = q.Remaining(john)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), remaining)
+	_, err = q.Reserve("app/", "app//user-4", 0)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded), "concurrent uploads of the client")
+
+	now = now.Add(24 * time.Hour)
+	u, err := q.Usage("app//jane")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), u.Bytes)
+	assert.Len(t, u.Active, 1)
+	u, err = q.ClientUsage("app/")
+	assert.NoError(t, err)
+	assert.Len(t, u.Active, 2)
+}
+
+func TestQuotaUploadInitiator(t *testing.T) {
+	q := NewQuotaTracker(newMemoryPersistence(), Quota{}, Quota{ConcurrentUploads: 1})
+	u := QuotaUploadInitiator{&initiator{}, q}
+	ctx := ContextWithVerifiedIdentity(context.Background(), VerifiedIdentity{ClientId: "app"})
+
+	// An id sent by the client does not let it skip the quota
+	data := metadata.UploadMetadata{ClientMediaId: "abc"}.ConvertToMetaData()
+	data.SetRaw(metadata.QuotaUploadId, "abc")
+	assert.NoError(t, u.InitiateNewUpload(ctx, &data))
+	id := data.GetRaw(metadata.QuotaUploadId)
+	assert.NotEqual(t, "abc", id)
+	again := metadata.UploadMetadata{ClientMediaId: "abc"}.ConvertToMetaData()
+	again.SetRaw(metadata.QuotaUploadId, id)
+	assert.True(t, errors.Is(u.InitiateNewUpload(ctx, &again), ErrQuotaExceeded))
+
+	c := QuotaUploadCompleter{&recordingConnector{}, q}
+	_, err := c.CompleteUpload(tusd.FileInfo{ID: "a", MetaData: tusd.MetaData(data)})
+	assert.NoError(t, err)
+	usage, _ := q.Usage("app//")
+	assert.Empty(t, usage.Active)
+}
+
+func TestQuotaByteCounter(t *testing.T) {
+	q := NewQuotaTracker(newMemoryPersistence(), Quota{}, Quota{BytesPerDay: 10})
+	id, err := q.Reserve("app/", "app//", 0)
+	assert.NoError(t, err)
+	data := metadata.Metadata{metadata.QuotaUploadId: id}
+	var received string
+	c := &QuotaByteCounter{Tracker: q, Lookup: func(r *http.Request) (tusd.FileInfo, error) {
+		return tusd.FileInfo{MetaData: tusd.MetaData(data)}, nil
+	}}
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		received = string(b)
+		if err != nil {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	patch := func(body string, chunked bool) int {
+		r := httptest.NewRequest(http.MethodPatch, "/files/a", strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, patch("hello", false))
+	assert.Equal(t, http.StatusTooManyRequests, patch("hello world", false), "the Content-Length is above the quota")
+	assert.Equal(t, http.StatusTooManyRequests, patch("hello world", true))
+	assert.Equal(t, "hello", received, "the body is cut off at the quota")
+	u, _ := q.Usage("app//")
+	assert.Equal(t, int64(10), u.Bytes)
+}
+
+func TestQuotaByteCounter_Concurrent(t *testing.T) {
+	q := NewQuotaTracker(newMemoryPersistence(), Quota{BytesPerDay: 10}, Quota{})
+	id, err := q.Reserve("app/", "app//", 0)
+	assert.NoError(t, err)
+	data := metadata.Metadata{metadata.QuotaUploadId: id}
+	c := &QuotaByteCounter{Tracker: q, Lookup: func(r *http.Request) (tusd.FileInfo, error) {
+		return tusd.FileInfo{MetaData: tusd.MetaData(data)}, nil
+	}}
+	// Both requests are let through before either has read its body
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inside <- struct{}{}
+		<-release
+		io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/files/a", strings.NewReader("hello!")))
+			codes <- w.Code
+		}()
+	}
+	<-inside
+	// The second request is rejected before its body is read, or waits to be let through
+	select {
+	case code := <-codes:
+		assert.Equal(t, http.StatusTooManyRequests, code)
+	case <-inside:
+		t.Fatal("both requests were let through")
+	}
+	close(release)
+	assert.Equal(t, http.StatusNoContent, <-codes)
+	u, _ := q.ClientUsage("app/")
+	assert.Equal(t, int64(6), u.Bytes)
+}
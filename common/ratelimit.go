@@ -0,0 +1,263 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/indicosystems/proxy-common/metadata"
+)
+
+var (
+	ErrRateLimited   = errors.New("too many requests")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Returned when a client is rejected by a RateLimiter or QuotaTracker.
+// The ValidationErrorResponse can be returned to the client as is. It is in the default locale, unless the
+// error was returned by a wrapper with a request or context, see Localized.
+type LimitError struct {
+	ValidationErrorResponse
+	// When the client may try again. Zero if unknown.
+	RetryAfter time.Duration
+	err        error
+	localize   func(loc Localizer) ValidationErrorResponse
+}
+
+func newLimitError(err error, retryAfter time.Duration, localize func(loc Localizer) ValidationErrorResponse) *LimitError {
+	return &LimitError{
+		ValidationErrorResponse: localize(defaultLocalizer()),
+		RetryAfter:              retryAfter,
+		err:                     err,
+		localize:                localize,
+	}
+}
+
+// Returns a copy of the error, with the ValidationErrorResponse localized by loc.
+func (e *LimitError) Localized(loc Localizer) *LimitError {
+	c := *e
+	if e.localize != nil {
+		c.ValidationErrorResponse = e.localize(loc)
+	}
+	return &c
+}
+
+// Returns a *LimitError in err localized by loc, or err as is.
+func localizeLimitError(err error, loc Localizer) error {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return limitErr.Localized(loc)
+	}
+	return err
+}
+
+func (e *LimitError) Error() string {
+	if e.Subtitle != "" {
+		return fmt.Sprintf("%s: %s", e.err, e.Subtitle)
+	}
+	return e.err.Error()
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.err
+}
+
+// Sets the Retry-After-header, if known.
+func (e *LimitError) SetHeaders(w http.ResponseWriter) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+}
+
+func newRateLimitError(retryAfter time.Duration) *LimitError {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	return newLimitError(ErrRateLimited, retryAfter, func(loc Localizer) ValidationErrorResponse {
+		res := loc.ValidationError("TooManyRequests", http.StatusTooManyRequests, "TooManyRequests.Title", "", nil,
+			Localizable{RawKey: "retryAfter", RawValue: strconv.Itoa(seconds)}.Localized(loc, "TooManyRequests.RetryAfter", "", nil))
+		res.Subtitle = loc.Plural("TooManyRequests.Subtitle", seconds, nil)
+		return res
+	})
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Returns the key used to limit the VerifiedIdentity. The limit is shared by all the users the client acts as,
+// so that a client cannot get a fresh limit by changing the as-user-fields.
+// Requests without a VerifiedIdentity share a single key.
+func IdentityLimitKey(id VerifiedIdentity) string {
+	return id.ClientId + "/" + firstNonEmpty(id.UserId, id.UserName, id.UserSid)
+}
+
+// Returns the key used to limit each user the identity acts as, within the limit of the identity.
+func RateLimitKey(id VerifiedIdentity, a AuthenticationPayload) string {
+	return IdentityLimitKey(id) + "/" + firstNonEmpty(a.UserId, a.UserName, a.UserSid)
+}
+
+type RateLimit struct {
+	// Requests per second
+	Rate float64
+	// The number of requests allowed in a burst
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token-bucket rate-limiter, keyed by the verified identity, and by the users it acts as.
+type RateLimiter struct {
+	// The limit per VerifiedIdentity, see IdentityLimitKey
+	ClientLimit RateLimit
+	// The limit per user, see RateLimitKey
+	Limit         RateLimit
+	mu            sync.Mutex
+	clientBuckets map[string]*tokenBucket
+	buckets       map[string]*tokenBucket
+	now           func() time.Time
+}
+
+func NewRateLimiter(client, user RateLimit) *RateLimiter {
+	return &RateLimiter{
+		ClientLimit:   client,
+		Limit:         user,
+		clientBuckets: map[string]*tokenBucket{},
+		buckets:       map[string]*tokenBucket{},
+		now:           time.Now,
+	}
+}
+
+// Returns the bucket for the key, refilled up to now.
+func refillBucket(buckets map[string]*tokenBucket, key string, l RateLimit, now time.Time) *tokenBucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst(), last: now}
+		buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst(), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	return b
+}
+
+func bucketLimitError(b *tokenBucket, l RateLimit) error {
+	if l.Rate <= 0 {
+		return newRateLimitError(0)
+	}
+	return newRateLimitError(time.Duration((1 - b.tokens) / l.Rate * float64(time.Second)))
+}
+
+// Takes a token for the key, within the per-user Limit. Returns a *LimitError wrapping ErrRateLimited if the
+// bucket is empty.
+func (r *RateLimiter) Allow(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := refillBucket(r.buckets, key, r.Limit, r.now())
+	if b.tokens < 1 {
+		return bucketLimitError(b, r.Limit)
+	}
+	b.tokens--
+	return nil
+}
+
+// Takes a token for the identity, and for the user of the payload it acts as. A token is only taken if both
+// buckets have one. Returns a *LimitError wrapping ErrRateLimited otherwise.
+func (r *RateLimiter) AllowIdentity(id VerifiedIdentity, a AuthenticationPayload) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	client := refillBucket(r.clientBuckets, IdentityLimitKey(id), r.ClientLimit, now)
+	if client.tokens < 1 {
+		return bucketLimitError(client, r.ClientLimit)
+	}
+	user := refillBucket(r.buckets, RateLimitKey(id, a), r.Limit, now)
+	if user.tokens < 1 {
+		return bucketLimitError(user, r.Limit)
+	}
+	client.tokens--
+	user.tokens--
+	return nil
+}
+
+// Removes buckets that are full, to limit memory-usage. Should be called periodically.
+func (r *RateLimiter) Prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	prune := func(buckets map[string]*tokenBucket, l RateLimit) {
+		for key, b := range buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.burst() {
+				delete(buckets, key)
+			}
+		}
+	}
+	prune(r.clientBuckets, r.ClientLimit)
+	prune(r.buckets, r.Limit)
+}
+
+// NewUploadInitiator that is rate-limited per identity and user, by the VerifiedIdentity and the
+// AuthenticationPayload on the context.
+type RateLimitedUploadInitiator struct {
+	NewUploadInitiator
+	Limiter *RateLimiter
+}
+
+func (u RateLimitedUploadInitiator) InitiateNewUpload(ctx context.Context, data *metadata.Metadata) error {
+	id, _ := VerifiedIdentityFromContext(ctx)
+	a, _ := AuthenticationPayloadFromContext(ctx)
+	if err := u.Limiter.AllowIdentity(id, a); err != nil {
+		return localizeLimitError(err, LocalizerFromContext(ctx))
+	}
+	return u.NewUploadInitiator.InitiateNewUpload(ctx, data)
+}
+
+// Validator that is rate-limited per identity and user, by the VerifiedIdentity on the request-context.
+type RateLimitedValidator struct {
+	Validator
+	Limiter *RateLimiter
+}
+
+func (v RateLimitedValidator) Validate(r *http.Request, a AuthenticationPayload, p ValidatePayload) (ValidateResponse, error) {
+	id, _ := VerifiedIdentityFromContext(r.Context())
+	if err := v.Limiter.AllowIdentity(id, a); err != nil {
+		return ValidateResponse{}, localizeLimitError(err, LocalizerFromRequest(r))
+	}
+	return v.Validator.Validate(r, a, p)
+}
+
+// SearchHandler that is rate-limited per identity and user, by the VerifiedIdentity on the context passed to
+// SearchContext. Search has no context, so those searches share the limit of requests without an identity.
+type RateLimitedSearchHandler struct {
+	SearchHandler
+	Limiter *RateLimiter
+}
+
+func (s RateLimitedSearchHandler) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	return s.SearchContext(context.Background(), a, in)
+}
+
+func (s RateLimitedSearchHandler) SearchContext(ctx context.Context, a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	id, _ := VerifiedIdentityFromContext(ctx)
+	if err := s.Limiter.AllowIdentity(id, a); err != nil {
+		return SearchResult{}, localizeLimitError(err, LocalizerFromContext(ctx))
+	}
+	return searchContext(ctx, s.SearchHandler, a, in)
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2021, 5, 12, 12, 0, 0, 0, time.UTC)
+	r := NewRateLimiter(RateLimit{Rate: 1, Burst: 3}, RateLimit{Rate: 1, Burst: 2})
+	r.now = func() time.Time { return now }
+	id := VerifiedIdentity{ClientId: "app"}
+	jane := AuthenticationPayload{ClientId: "app", UserId: "jane"}
+	key := RateLimitKey(id, jane)
+
+	assert.NoError(t, r.Allow(key))
+	assert.NoError(t, r.Allow(key))
+	err := r.Allow(key)
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	var limitErr *LimitError
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, http.StatusTooManyRequests, limitErr.StatusCode)
+		assert.Equal(t, time.Second, limitErr.RetryAfter)
+		assert.Equal(t, "Please try again in 1 second", limitErr.Subtitle)
+		assert.Equal(t, "Retry after (seconds)", limitErr.Details[0].Key)
+	}
+	assert.NoError(t, r.Allow(RateLimitKey(id, AuthenticationPayload{ClientId: "app", UserId: "john"})), "users are limited separately")
+
+	now = now.Add(time.Second)
+	assert.NoError(t, r.Allow(key))
+}
+
+func TestRateLimiter_AllowIdentity(t *testing.T) {
+	now := time.Date(2021, 5, 12, 12, 0, 0, 0, time.UTC)
+	r := NewRateLimiter(RateLimit{Rate: 1, Burst: 3}, RateLimit{Rate: 1, Burst: 2})
+	r.now = func() time.Time { return now }
+	id := VerifiedIdentity{ClientId: "app"}
+
+	assert.NoError(t, r.AllowIdentity(id, AuthenticationPayload{UserId: "jane"}))
+	assert.NoError(t, r.AllowIdentity(id, AuthenticationPayload{UserId: "jane"}))
+	assert.True(t, errors.Is(r.AllowIdentity(id, AuthenticationPayload{UserId: "jane"}), ErrRateLimited), "the limit of the user")
+	assert.NoError(t, r.AllowIdentity(id, AuthenticationPayload{UserId: "john"}))
+	// Changing the as-user-fields does not give the client a fresh limit
+	assert.True(t, errors.Is(r.AllowIdentity(id, AuthenticationPayload{UserId: "user-4"}), ErrRateLimited), "the limit of the client")
+	assert.NoError(t, r.AllowIdentity(VerifiedIdentity{ClientId: "other"}, AuthenticationPayload{UserId: "jane"}))
+}
+
+func TestRateLimitedValidator_Localized(t *testing.T) {
+	v := RateLimitedValidator{Validator: &countingValidator{}, Limiter: NewRateLimiter(RateLimit{Rate: 1, Burst: 5}, RateLimit{Rate: 1})}
+	r, _ := http.NewRequest(http.MethodPost, "/validate", nil)
+	r.Header.Set("Accept-Language", "nb")
+	_, err := v.Validate(r, AuthenticationPayload{}, ValidatePayload{CaseID: "C1"})
+	assert.NoError(t, err)
+	_, err = v.Validate(r, AuthenticationPayload{}, ValidatePayload{CaseID: "C1"})
+	var limitErr *LimitError
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, "For mange forespørsler", limitErr.Title)
+		assert.Equal(t, "Prøv igjen etter (sekunder)", limitErr.Details[0].Key)
+	}
+}
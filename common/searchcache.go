@@ -0,0 +1,177 @@
+package common
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SearchCacheOptions struct {
+	// How long results are fresh.
+	TTL time.Duration
+	// How long after the TTL a stale result is still returned, while it is refreshed in the background.
+	// Zero disables stale-while-revalidate.
+	StaleTTL time.Duration
+	// The maximum number of cached results. Defaults to 1000.
+	MaxEntries int
+}
+
+type searchCacheEntry struct {
+	key      string
+	result   SearchResult
+	storedAt time.Time
+}
+
+// A search of the backend in progress, shared by all callers missing the same key.
+type searchCall struct {
+	// Closed when the search completes
+	done chan struct{}
+	res  SearchResult
+	err  error
+}
+
+// SearchHandler caching results by SearchCacheKey, combined with SearchInput.Key, so that inputs differing in
+// fields the connector leaves out of its key, like the Limit or the Cursor, are not mixed up.
+//
+// If the connector's SearchOptions.RequiresAuthentication is set, the identity is always part of the key,
+// so that results are never shared across users. Concurrent misses for the same key share a single search of the
+// backend. Errors are not cached.
+type CachedSearchHandler struct {
+	SearchHandler
+	Options SearchCacheOptions
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// Searches in progress, including background-refreshes
+	calls map[string]*searchCall
+	now   func() time.Time
+}
+
+func NewCachedSearchHandler(h SearchHandler, o SearchCacheOptions) *CachedSearchHandler {
+	if o.MaxEntries <= 0 {
+		o.MaxEntries = 1000
+	}
+	return &CachedSearchHandler{
+		SearchHandler: h,
+		Options:       o,
+		entries:       map[string]*list.Element{},
+		lru:           list.New(),
+		calls:         map[string]*searchCall{},
+		now:           time.Now,
+	}
+}
+
+func (c *CachedSearchHandler) cacheKey(a AuthenticationPayload, in SearchInput) string {
+	key := c.SearchHandler.SearchCacheKey(a, in)
+	if key == "" {
+		return ""
+	}
+	key = strings.Join([]string{key, in.Key()}, "\x00")
+	if _, o := c.SearchHandler.SearchableFields(); o.RequiresAuthentication {
+		key = strings.Join([]string{key, a.ClientId, a.UserName, a.UserId, a.UserSid}, "\x00")
+	}
+	return key
+}
+
+func (c *CachedSearchHandler) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	key := c.cacheKey(a, in)
+	if key == "" {
+		return c.SearchHandler.Search(a, in)
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*searchCacheEntry)
+		age := c.now().Sub(e.storedAt)
+		if age < c.Options.TTL {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return copySearchResult(e.result), nil
+		}
+		if age < c.Options.TTL+c.Options.StaleTTL {
+			c.lru.MoveToFront(el)
+			c.search(key, a, in)
+			c.mu.Unlock()
+			return copySearchResult(e.result), nil
+		}
+	}
+	call := c.search(key, a, in)
+	c.mu.Unlock()
+
+	<-call.done
+	if call.err != nil {
+		return call.res, call.err
+	}
+	return copySearchResult(call.res), nil
+}
+
+// Starts a search of the backend for the key, unless one is already in progress, and returns it.
+// The result is stored before the search is done, so that later callers find it. Must be called with mu held.
+func (c *CachedSearchHandler) search(key string, a AuthenticationPayload, in SearchInput) *searchCall {
+	if call, ok := c.calls[key]; ok {
+		return call
+	}
+	call := &searchCall{done: make(chan struct{})}
+	c.calls[key] = call
+	go func() {
+		call.res, call.err = c.SearchHandler.Search(a, in)
+		if call.err == nil {
+			c.store(key, call.res)
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// Stores a copy of the result, so that callers modifying the result they got do not modify the cache.
+func (c *CachedSearchHandler) store(key string, res SearchResult) {
+	res = copySearchResult(res)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*searchCacheEntry)
+		e.result = res
+		e.storedAt = c.now()
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&searchCacheEntry{key: key, result: res, storedAt: c.now()})
+	for c.lru.Len() > c.Options.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*searchCacheEntry).key)
+	}
+}
+
+func copySearchAggregate(a *SearchAggregate) *SearchAggregate {
+	if a == nil {
+		return nil
+	}
+	c := *a
+	if a.Items != nil {
+		c.Items = append([]SearchResultItem(nil), a.Items...)
+	}
+	return &c
+}
+
+// Returns a deep copy of the result, as the aggregates are shared by pointer.
+func copySearchResult(r SearchResult) SearchResult {
+	return SearchResult{
+		User:   copySearchAggregate(r.User),
+		Parent: copySearchAggregate(r.Parent),
+		Case:   copySearchAggregate(r.Case),
+		Group:  copySearchAggregate(r.Group),
+		Errors: append([]SearchError(nil), r.Errors...),
+	}
+}
+
+// Removes all cached results.
+func (c *CachedSearchHandler) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingSearcher struct {
+	mu      sync.Mutex
+	calls   int
+	auth    bool
+	err     error
+	release chan struct{}
+}
+
+func (s *countingSearcher) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return SearchResult{User: &SearchAggregate{Items: []SearchResultItem{{ID: a.UserName, DisplayName: in.Query}}}}, s.err
+}
+func (s *countingSearcher) SearchCacheKey(a AuthenticationPayload, in SearchInput) string {
+	return string(in.Kind) + ":" + in.Query
+}
+func (s *countingSearcher) SearchableFields() (*SupportedSearches, SearchOptions) {
+	return &SupportedSearches{UserName: true}, SearchOptions{RequiresAuthentication: s.auth}
+}
+func (s *countingSearcher) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestCachedSearchHandler(t *testing.T) {
+	now := time.Date(2021, 5, 12, 12, 0, 0, 0, time.UTC)
+	s := &countingSearcher{auth: true}
+	c := NewCachedSearchHandler(s, SearchCacheOptions{TTL: time.Minute, StaleTTL: time.Minute, MaxEntries: 2})
+	c.now = func() time.Time { return now }
+	jane := AuthenticationPayload{ClientId: "app", UserName: "jane"}
+	john := AuthenticationPayload{ClientId: "app", UserName: "john"}
+	in := SearchInput{Query: "bu", Kind: "UserName"}
+
+	c.Search(jane, in)
+	res, _ := c.Search(jane, in)
+	assert.Equal(t, 1, s.Calls())
+	res, _ = c.Search(john, in)
+	assert.Equal(t, 2, s.Calls(), "authenticated results should not be shared")
+	assert.Equal(t, "john", res.User.Items[0].ID)
+
+	// Stale results are returned while refreshing in the background
+	now = now.Add(90 * time.Second)
+	s.release = make(chan struct{})
+	res, _ = c.Search(jane, in)
+	assert.Equal(t, "jane", res.User.Items[0].ID)
+	c.Search(jane, in)
+	close(s.release)
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.calls) == 0
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 3, s.Calls())
+	s.release = nil
+
+	// Expired results are fetched again
+	now = now.Add(5 * time.Minute)
+	c.Search(jane, in)
+	assert.Equal(t, 4, s.Calls())
+
+	// Fields the connector leaves out of its key are still part of the cache-key
+	c.Search(jane, SearchInput{Query: "bu", Kind: "UserName", Limit: 1})
+	assert.Equal(t, 5, s.Calls())
+
+	// Errors are not cached
+	s.err = errors.New("timeout")
+	_, err := c.Search(jane, SearchInput{Query: "x"})
+	assert.Error(t, err)
+	_, err = c.Search(jane, SearchInput{Query: "x"})
+	assert.Error(t, err)
+	assert.Equal(t, 7, s.Calls())
+}
+
+func TestCachedSearchHandler_SharedMiss(t *testing.T) {
+	s := &countingSearcher{release: make(chan struct{})}
+	c := NewCachedSearchHandler(s, SearchCacheOptions{TTL: time.Minute})
+	in := SearchInput{Query: "bu", Kind: "UserName"}
+
+	var wg sync.WaitGroup
+	results := make([]SearchResult, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.Search(AuthenticationPayload{}, in)
+		}(i)
+	}
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.calls) == 1
+	}, time.Second, time.Millisecond)
+	close(s.release)
+	wg.Wait()
+	assert.Equal(t, 1, s.Calls(), "concurrent misses share a single search")
+	for _, res := range results {
+		assert.Equal(t, "bu", res.User.Items[0].DisplayName)
+	}
+	results[0].User.Items[0].DisplayName = "modified"
+	assert.Equal(t, "bu", results[1].User.Items[0].DisplayName, "each caller gets its own copy")
+}
+
+func TestCachedSearchHandler_Copies(t *testing.T) {
+	s := &countingSearcher{}
+	c := NewCachedSearchHandler(s, SearchCacheOptions{TTL: time.Minute})
+	in := SearchInput{Query: "bu", Kind: "UserName"}
+
+	res, _ := c.Search(AuthenticationPayload{}, in)
+	res.User.Items[0].DisplayName = "modified"
+	res.User.HasMore = HasMoreTrue
+	res, _ = c.Search(AuthenticationPayload{}, in)
+	assert.Equal(t, 1, s.Calls())
+	assert.Equal(t, "bu", res.User.Items[0].DisplayName, "the first result should not share the cached aggregate")
+	res.User.Items = append(res.User.Items[:0], SearchResultItem{ID: "other"})
+	res, _ = c.Search(AuthenticationPayload{}, in)
+	assert.Equal(t, HasMoreUnknown, res.User.HasMore)
+	assert.Equal(t, "bu", res.User.Items[0].DisplayName, "cached results should not be modified through returned results")
+}
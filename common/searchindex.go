@@ -0,0 +1,336 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type SearchIndexKind string
+
+const (
+	IndexUser   SearchIndexKind = "User"
+	IndexParent SearchIndexKind = "Parent"
+	IndexCase   SearchIndexKind = "Case"
+	IndexGroup  SearchIndexKind = "Group"
+)
+
+type indexedItem struct {
+	item SearchResultItem
+	// Normalized fields, and the words within them
+	fields []string
+	words  []string
+}
+
+// A local search-index for connectors whose backends are too slow for typeahead.
+//
+// The connector fills the index periodically, and serves SearchHandler.Search from it.
+// Matching is case- and accent-insensitive, on prefixes and with a small edit-distance, over
+// DisplayName and AltDisplayName. IDs are matched exactly.
+type SearchIndex struct {
+	// The maximum edit-distance for fuzzy matches. Short queries allow fewer edits.
+	MaxDistance int
+	mu          sync.RWMutex
+	items       map[SearchIndexKind][]indexedItem
+	updatedAt   time.Time
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		MaxDistance: 2,
+		items:       map[SearchIndexKind][]indexedItem{},
+	}
+}
+
+// Replaces all items of the kind.
+func (s *SearchIndex) Replace(kind SearchIndexKind, items []SearchResultItem) {
+	indexed := indexSearchItems(items)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[kind] = indexed
+	s.updatedAt = time.Now()
+}
+
+// Replaces the whole index. Kinds missing from items are cleared.
+func (s *SearchIndex) ReplaceAll(items map[SearchIndexKind][]SearchResultItem) {
+	indexed := make(map[SearchIndexKind][]indexedItem, len(items))
+	for kind, list := range items {
+		indexed[kind] = indexSearchItems(list)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = indexed
+	s.updatedAt = time.Now()
+}
+
+func indexSearchItems(items []SearchResultItem) []indexedItem {
+	indexed := make([]indexedItem, len(items))
+	for i, item := range items {
+		ii := indexedItem{item: item}
+		for _, f := range []string{item.DisplayName, item.AltDisplayName} {
+			if n := normalizeSearchText(f); n != "" {
+				ii.fields = append(ii.fields, n)
+				ii.words = append(ii.words, strings.Fields(n)...)
+			}
+		}
+		indexed[i] = ii
+	}
+	return indexed
+}
+
+// The last time the index was filled.
+func (s *SearchIndex) UpdatedAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.updatedAt
+}
+
+// Fills the index with fill at the interval, until the context is done. Each fill replaces the whole index, see
+// ReplaceAll. Failures leave the previous items in place, and are passed to onErr, if set.
+func (s *SearchIndex) Refresh(ctx context.Context, interval time.Duration, fill func(ctx context.Context) (map[SearchIndexKind][]SearchResultItem, error), onErr func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		items, err := fill(ctx)
+		if err != nil {
+			if onErr != nil {
+				onErr(err)
+			}
+		} else {
+			s.ReplaceAll(items)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Searches the index. If the Kind is empty, all kinds are searched, while an unknown Kind is rejected with
+// ErrInvalidSearch. Offset and Sort are supported, while Filters and Cursor are not, as items are indexed per kind.
+// They are rejected with ErrUnsupportedSearch. Both errors can be passed to SearchInputError.
+func (s *SearchIndex) Search(in SearchInput) (SearchResult, error) {
+	if len(in.Filters) > 0 {
+		return SearchResult{}, fmt.Errorf("%w: filtering the search-index", ErrUnsupportedSearch)
+	}
+	if in.Cursor != "" {
+		return SearchResult{}, fmt.Errorf("%w: cursors in the search-index", ErrUnsupportedSearch)
+	}
+	var kinds []SearchIndexKind
+	if in.Kind == "" {
+		kinds = []SearchIndexKind{IndexUser, IndexParent, IndexCase, IndexGroup}
+	} else if d, ok := Field(in.Kind); ok {
+		kinds = []SearchIndexKind{SearchIndexKind(d.Entity)}
+	} else {
+		return SearchResult{}, fmt.Errorf("%w: unknown kind '%s'", ErrInvalidSearch, in.Kind)
+	}
+	var res SearchResult
+	for _, k := range kinds {
+		agg := s.search(k, in)
+		switch k {
+		case IndexUser:
+			res.User = agg
+		case IndexParent:
+			res.Parent = agg
+		case IndexCase:
+			res.Case = agg
+		case IndexGroup:
+			res.Group = agg
+		}
+	}
+	return res, nil
+}
+
+type scoredItem struct {
+	item  SearchResultItem
+	score int
+}
+
+func (s *SearchIndex) search(kind SearchIndexKind, in SearchInput) *SearchAggregate {
+	query := normalizeSearchText(in.Query)
+	maxDistance := s.MaxDistance
+	switch n := len([]rune(query)); {
+	case n < 4:
+		maxDistance = 0
+	case n < 8 && maxDistance > 1:
+		maxDistance = 1
+	}
+
+	s.mu.RLock()
+	var matches []scoredItem
+	for _, ii := range s.items[kind] {
+		if score, ok := matchSearchItem(ii, in.Query, query, maxDistance); ok {
+			matches = append(matches, scoredItem{ii.item, score})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		for _, s := range in.Sort {
+			var a, b string
+			switch s.Field {
+			case SortID:
+				a, b = matches[i].item.ID, matches[j].item.ID
+			case SortDisplayName:
+				a, b = matches[i].item.DisplayName, matches[j].item.DisplayName
+			default:
+				if matches[i].score == matches[j].score {
+					continue
+				}
+				return (matches[i].score < matches[j].score) != s.Descending
+			}
+			if a != b {
+				return (a < b) != s.Descending
+			}
+		}
+		if matches[i].score != matches[j].score {
+			return matches[i].score < matches[j].score
+		}
+		return matches[i].item.DisplayName < matches[j].item.DisplayName
+	})
+	agg := &SearchAggregate{Offset: in.Offset, HasMore: HasMoreNo}
+	if in.Offset >= len(matches) {
+		matches = nil
+	} else if in.Offset > 0 {
+		matches = matches[in.Offset:]
+	}
+	if in.Limit > 0 && len(matches) > in.Limit {
+		matches = matches[:in.Limit]
+		agg.HasMore = HasMoreTrue
+	}
+	for _, m := range matches {
+		agg.Items = append(agg.Items, m.item)
+	}
+	return agg
+}
+
+// Returns a score for how well the item matches, where lower is better.
+func matchSearchItem(ii indexedItem, raw, query string, maxDistance int) (int, bool) {
+	if query == "" {
+		return 10, true
+	}
+	if raw != "" && (ii.item.ID == raw || ii.item.AltID == raw) {
+		return 0, true
+	}
+	best := -1
+	better := func(score int) {
+		if best < 0 || score < best {
+			best = score
+		}
+	}
+	for _, f := range ii.fields {
+		switch {
+		case f == query:
+			better(1)
+		case strings.HasPrefix(f, query):
+			better(2)
+		case strings.Contains(f, query):
+			better(4)
+		}
+	}
+	for _, w := range ii.words {
+		if strings.HasPrefix(w, query) {
+			better(3)
+		}
+	}
+	if best >= 0 || maxDistance == 0 {
+		return best, best >= 0
+	}
+	// Fuzzy: compare against words, and the prefixes of words, of similar length
+	q := []rune(query)
+	for _, w := range ii.words {
+		r := []rune(w)
+		for n := len(q) - 1; n <= len(q)+1; n++ {
+			prefix := r
+			if len(prefix) > n {
+				prefix = prefix[:n]
+			}
+			if d := editDistance(q, prefix, maxDistance); d <= maxDistance {
+				better(5 + d)
+			}
+		}
+	}
+	return best, best >= 0
+}
+
+// Levenshtein-distance, giving up when the distance exceeds max.
+func editDistance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a int, rest ...int) int {
+	for _, b := range rest {
+		if b < a {
+			a = b
+		}
+	}
+	return a
+}
+
+// Folds accented latin characters to their base-letters
+var accentFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ľ': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ŕ': "r", 'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// Lowercases, folds accents and collapses whitespace and punctuation.
+func normalizeSearchText(s string) string {
+	var b strings.Builder
+	space := true
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case accentFolds[r] != "":
+			b.WriteString(accentFolds[r])
+			space = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			space = false
+		case unicode.Is(unicode.Mn, r):
+			// Combining marks, as in decomposed accents
+		default:
+			if !space {
+				b.WriteRune(' ')
+				space = true
+			}
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
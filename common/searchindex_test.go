@@ -0,0 +1,103 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchIndex(t *testing.T) {
+	idx := NewSearchIndex()
+	idx.Replace(IndexCase, []SearchResultItem{
+		{ID: "C6288", DisplayName: "Burglar downtown", AltDisplayName: "Innbrudd sentrum"},
+		{ID: "C6289", DisplayName: "Bøygen-saken"},
+		{ID: "C6290", DisplayName: "Café Müller"},
+		{ID: "C6291", DisplayName: "Burger theft"},
+	})
+	idx.Replace(IndexUser, []SearchResultItem{{ID: "jane", DisplayName: "Jane Doe"}})
+
+	ids := func(res SearchResult) (ids []string) {
+		if res.Case == nil {
+			return nil
+		}
+		for _, item := range res.Case.Items {
+			ids = append(ids, item.ID)
+		}
+		return
+	}
+	tests := []struct {
+		name    string
+		in      SearchInput
+		want    []string
+		hasMore HasMore
+	}{
+		{"prefix", SearchInput{Query: "burg", Kind: "CaseName"}, []string{"C6291", "C6288"}, HasMoreNo},
+		{"word-prefix", SearchInput{Query: "downt", Kind: "CaseName"}, []string{"C6288"}, HasMoreNo},
+		{"alternative name", SearchInput{Query: "innbrudd", Kind: "CaseName"}, []string{"C6288"}, HasMoreNo},
+		{"accent-insensitive", SearchInput{Query: "boygen", Kind: "CaseName"}, []string{"C6289"}, HasMoreNo},
+		{"accents in query", SearchInput{Query: "cafe muller", Kind: "CaseName"}, []string{"C6290"}, HasMoreNo},
+		{"fuzzy", SearchInput{Query: "downtwn", Kind: "CaseName"}, []string{"C6288"}, HasMoreNo},
+		{"exact id", SearchInput{Query: "C6290", Kind: "CaseID"}, []string{"C6290"}, HasMoreNo},
+		{"limit", SearchInput{Query: "bur", Kind: "CaseName", Limit: 1}, []string{"C6291"}, HasMoreTrue},
+		{"offset", SearchInput{Query: "bur", Kind: "CaseName", Offset: 1}, []string{"C6288"}, HasMoreNo},
+		{"sorted", SearchInput{Query: "bur", Kind: "CaseName", Sort: []SearchSort{{Field: SortID, Descending: true}}}, []string{"C6291", "C6288"}, HasMoreNo},
+		{"sorted ascending", SearchInput{Query: "bur", Kind: "CaseName", Sort: []SearchSort{{Field: SortID}}}, []string{"C6288", "C6291"}, HasMoreNo},
+		{"no match", SearchInput{Query: "xyz", Kind: "CaseName"}, nil, HasMoreNo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := idx.Search(tt.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, ids(res))
+			assert.Equal(t, tt.hasMore, res.Case.HasMore)
+			assert.Nil(t, res.User)
+		})
+	}
+	res, err := idx.Search(SearchInput{Query: "jane"})
+	assert.NoError(t, err)
+	assert.Len(t, res.User.Items, 1)
+	assert.Empty(t, res.Case.Items)
+
+	_, err = idx.Search(SearchInput{Query: "burg", Filters: []SearchFilter{{Field: SearchUserID, Value: "jane"}}})
+	assert.True(t, errors.Is(err, ErrUnsupportedSearch))
+	assert.Equal(t, http.StatusUnprocessableEntity, SearchInputError(defaultLocalizer(), err).StatusCode)
+	_, err = idx.Search(SearchInput{Query: "burg", Cursor: "2"})
+	assert.True(t, errors.Is(err, ErrUnsupportedSearch))
+	_, err = idx.Search(SearchInput{Query: "burg", Kind: "Unknown"})
+	assert.True(t, errors.Is(err, ErrInvalidSearch))
+	assert.Equal(t, http.StatusBadRequest, SearchInputError(defaultLocalizer(), err).StatusCode)
+}
+
+func TestSearchIndex_Refresh(t *testing.T) {
+	idx := NewSearchIndex()
+	fills := []map[SearchIndexKind][]SearchResultItem{
+		{IndexUser: {{ID: "jane", DisplayName: "Jane"}}, IndexCase: {{ID: "C1", DisplayName: "Burglary"}}},
+		{IndexUser: {{ID: "john", DisplayName: "John"}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		idx.Refresh(ctx, time.Millisecond, func(ctx context.Context) (map[SearchIndexKind][]SearchResultItem, error) {
+			fill := fills[0]
+			if len(fills) > 1 {
+				fills = fills[1:]
+			} else {
+				cancel()
+			}
+			return fill, nil
+		}, nil)
+	}()
+	<-done
+
+	res, err := idx.Search(SearchInput{Query: "burg", Kind: "CaseName"})
+	assert.NoError(t, err)
+	assert.Empty(t, res.Case.Items, "kinds missing from the fill are cleared")
+	res, err = idx.Search(SearchInput{Query: "j", Kind: "UserName"})
+	assert.NoError(t, err)
+	assert.Equal(t, []SearchResultItem{{ID: "john", DisplayName: "John"}}, res.User.Items)
+}
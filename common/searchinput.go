@@ -0,0 +1,157 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnsupportedSearch = errors.New("the search is not supported by the connector")
+	ErrInvalidSearch     = errors.New("invalid search")
+)
+
+// The kinds of searches, matching the fields of SupportedSearches. Also names the fields of FieldDescriptors.
+type SearchKind string
+
+const (
+	SearchUserID     SearchKind = "UserID"
+	SearchUserName   SearchKind = "UserName"
+	SearchSid        SearchKind = "Sid"
+	SearchParentID   SearchKind = "ParentID"
+	SearchParentName SearchKind = "ParentName"
+	SearchCaseID     SearchKind = "CaseID"
+	SearchCaseName   SearchKind = "CaseName"
+	SearchGroupName  SearchKind = "GroupName"
+	SearchGroupID    SearchKind = "GroupID"
+)
+
+func (k SearchKind) Valid() bool {
+	_, ok := Field(k)
+	return ok
+}
+
+type SearchFilterOp string
+
+const (
+	FilterEquals   SearchFilterOp = "equals"
+	FilterContains SearchFilterOp = "contains"
+	FilterPrefix   SearchFilterOp = "prefix"
+)
+
+type SearchFilter struct {
+	Field SearchKind
+	// Defaults to FilterEquals
+	Op    SearchFilterOp `json:",omitempty"`
+	Value string
+}
+
+type SearchSortField string
+
+const (
+	SortRelevance   SearchSortField = "relevance"
+	SortID          SearchSortField = "ID"
+	SortDisplayName SearchSortField = "DisplayName"
+)
+
+type SearchSort struct {
+	Field      SearchSortField
+	Descending bool `json:",omitempty"`
+}
+
+// Validates the input against what the connector reports in SearchableFields.
+// Unsupported kinds, filters, sorting and cursors are rejected with ErrUnsupportedSearch,
+// and malformed input with ErrInvalidSearch.
+func ValidateSearchInput(h SearchHandler, in SearchInput) error {
+	supported, options := h.SearchableFields()
+	if in.Limit < 0 {
+		return fmt.Errorf("%w: the limit cannot be negative", ErrInvalidSearch)
+	}
+	if in.Offset < 0 {
+		return fmt.Errorf("%w: the offset cannot be negative", ErrInvalidSearch)
+	}
+	if in.Offset > 0 && in.Cursor != "" {
+		return fmt.Errorf("%w: offset and cursor cannot be combined", ErrInvalidSearch)
+	}
+	if in.Kind != "" {
+		if !in.Kind.Valid() {
+			return fmt.Errorf("%w: unknown kind '%s'", ErrInvalidSearch, in.Kind)
+		}
+		if !supported.IsEnabled(in.Kind) {
+			return fmt.Errorf("%w: searching by '%s'", ErrUnsupportedSearch, in.Kind)
+		}
+	}
+	if in.Cursor != "" && !options.SupportsCursor {
+		return fmt.Errorf("%w: cursors", ErrUnsupportedSearch)
+	}
+	for _, f := range in.Filters {
+		if !f.Field.Valid() {
+			return fmt.Errorf("%w: unknown filter-field '%s'", ErrInvalidSearch, f.Field)
+		}
+		switch f.Op {
+		case "", FilterEquals, FilterContains, FilterPrefix:
+		default:
+			return fmt.Errorf("%w: unknown filter-operator '%s'", ErrInvalidSearch, f.Op)
+		}
+		if !supported.IsEnabled(f.Field) {
+			return fmt.Errorf("%w: filtering by '%s'", ErrUnsupportedSearch, f.Field)
+		}
+	}
+	for _, s := range in.Sort {
+		if s.Field == SortRelevance {
+			continue
+		}
+		supportedSort := false
+		for _, field := range options.SortFields {
+			if field == s.Field {
+				supportedSort = true
+				break
+			}
+		}
+		if !supportedSort {
+			return fmt.Errorf("%w: sorting by '%s'", ErrUnsupportedSearch, s.Field)
+		}
+	}
+	return nil
+}
+
+// Returns a response for an error from ValidateSearchInput, localized by loc, that can be returned to the client.
+// The error itself is included as a detail.
+func SearchInputError(loc Localizer, err error) ValidationErrorResponse {
+	status, subtitleKey := http.StatusBadRequest, "InvalidSearch.Subtitle"
+	if errors.Is(err, ErrUnsupportedSearch) {
+		status, subtitleKey = http.StatusUnprocessableEntity, "InvalidSearch.Unsupported"
+	}
+	return loc.ValidationError("InvalidSearch", status, "InvalidSearch.Title", subtitleKey, nil,
+		Localizable{RawKey: "reason", RawValue: err.Error()}.Localized(loc, "Error.Reason", "", nil))
+}
+
+// SearchHandler that validates the input with ValidateSearchInput before it reaches the connector.
+type ValidatedSearchHandler struct {
+	SearchHandler
+}
+
+func (s ValidatedSearchHandler) Search(a AuthenticationPayload, in SearchInput) (SearchResult, error) {
+	if err := ValidateSearchInput(s.SearchHandler, in); err != nil {
+		return SearchResult{}, err
+	}
+	return s.SearchHandler.Search(a, in)
+}
+
+// Returns a key covering every field of the input, to be used in SearchCacheKey.
+func (in SearchInput) Key() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\x00%q\x00%d\x00%d\x00%q", in.Kind, in.Query, in.Limit, in.Offset, in.Cursor)
+	for _, f := range in.Filters {
+		op := f.Op
+		if op == "" {
+			op = FilterEquals
+		}
+		fmt.Fprintf(&b, "\x00f:%s:%s:%q", f.Field, op, f.Value)
+	}
+	for _, s := range in.Sort {
+		fmt.Fprintf(&b, "\x00s:%s:%t", s.Field, s.Descending)
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fieldsSearcher struct {
+	staticSearcher
+	options SearchOptions
+}
+
+func (s fieldsSearcher) SearchableFields() (*SupportedSearches, SearchOptions) {
+	return &SupportedSearches{UserName: true, CaseName: true}, s.options
+}
+
+func TestValidateSearchInput(t *testing.T) {
+	h := fieldsSearcher{options: SearchOptions{SortFields: []SearchSortField{SortDisplayName}}}
+	tests := []struct {
+		name string
+		in   SearchInput
+		want error
+	}{
+		{"empty", SearchInput{}, nil},
+		{"supported kind", SearchInput{Kind: SearchCaseName, Query: "burglar"}, nil},
+		{"unsupported kind", SearchInput{Kind: SearchCaseID}, ErrUnsupportedSearch},
+		{"unknown kind", SearchInput{Kind: "Banana"}, ErrInvalidSearch},
+		{"filter", SearchInput{Kind: SearchCaseName, Filters: []SearchFilter{{Field: SearchUserName, Op: FilterContains, Value: "jane"}}}, nil},
+		{"unsupported filter", SearchInput{Filters: []SearchFilter{{Field: SearchGroupID, Value: "g"}}}, ErrUnsupportedSearch},
+		{"unknown operator", SearchInput{Filters: []SearchFilter{{Field: SearchUserName, Op: "like"}}}, ErrInvalidSearch},
+		{"sort", SearchInput{Sort: []SearchSort{{Field: SortDisplayName, Descending: true}, {Field: SortRelevance}}}, nil},
+		{"unsupported sort", SearchInput{Sort: []SearchSort{{Field: SortID}}}, ErrUnsupportedSearch},
+		{"negative offset", SearchInput{Offset: -1}, ErrInvalidSearch},
+		{"offset and cursor", SearchInput{Offset: 10, Cursor: "abc"}, ErrInvalidSearch},
+		{"unsupported cursor", SearchInput{Cursor: "abc"}, ErrUnsupportedSearch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSearchInput(h, tt.in)
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, tt.want), err)
+		})
+	}
+
+	h.options.SupportsCursor = true
+	assert.NoError(t, ValidateSearchInput(h, SearchInput{Cursor: "abc"}))
+
+	nb := DefaultCatalog().Localizer("nb")
+	res := SearchInputError(nb, ValidateSearchInput(h, SearchInput{Kind: SearchCaseID}))
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	assert.Equal(t, "Søket støttes ikke av denne koblingen", res.Subtitle)
+	res = SearchInputError(defaultLocalizer(), ValidateSearchInput(h, SearchInput{Offset: -1}))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, "The search is not valid", res.Subtitle)
+
+	_, err := ValidatedSearchHandler{h}.Search(AuthenticationPayload{}, SearchInput{Kind: SearchGroupName})
+	assert.True(t, errors.Is(err, ErrUnsupportedSearch))
+}
+
+func TestSearchInputKey(t *testing.T) {
+	base := SearchInput{Kind: SearchCaseName, Query: "x"}
+	variants := []SearchInput{
+		{Kind: SearchCaseName, Query: "x", Offset: 10},
+		{Kind: SearchCaseName, Query: "x", Cursor: "c"},
+		{Kind: SearchCaseName, Query: "x", Filters: []SearchFilter{{Field: SearchUserName, Value: "jane"}}},
+		{Kind: SearchCaseName, Query: "x", Sort: []SearchSort{{Field: SortID}}},
+	}
+	for _, v := range variants {
+		assert.NotEqual(t, base.Key(), v.Key())
+	}
+	assert.Equal(t,
+		SearchInput{Filters: []SearchFilter{{Field: SearchUserName, Value: "jane"}}}.Key(),
+		SearchInput{Filters: []SearchFilter{{Field: SearchUserName, Op: FilterEquals, Value: "jane"}}}.Key())
+}
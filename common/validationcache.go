@@ -0,0 +1,129 @@
+package common
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ValidationCacheOptions struct {
+	// How long valid results are cached.
+	TTL time.Duration
+	// How long results holding a ValidationErrorResponse, like an unknown CaseID, are cached.
+	// Zero disables caching of these.
+	NegativeTTL time.Duration
+	// The maximum number of cached results. Defaults to 1000.
+	MaxEntries int
+}
+
+type validationCacheEntry struct {
+	key       string
+	response  ValidateResponse
+	expiresAt time.Time
+}
+
+// Validator caching results by the payload and identity.
+//
+// Results are cached separately with TTL or NegativeTTL, depending on whether any field holds a
+// ValidationErrorResponse. Errors returned from Validate, like a backend being unavailable, are never cached,
+// nor are results where a field holds an error without a StatusCode, or with a StatusCode of 500 or above.
+// The request is not part of the key, so the connector should not depend on anything in it but the identity.
+type CachedValidator struct {
+	Validator
+	Options ValidationCacheOptions
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+func NewCachedValidator(v Validator, o ValidationCacheOptions) *CachedValidator {
+	if o.MaxEntries <= 0 {
+		o.MaxEntries = 1000
+	}
+	return &CachedValidator{
+		Validator: v,
+		Options:   o,
+		entries:   map[string]*list.Element{},
+		lru:       list.New(),
+		now:       time.Now,
+	}
+}
+
+func validationCacheKey(a AuthenticationPayload, p ValidatePayload) string {
+	parts := []string{a.ClientId, a.UserName, a.UserId, a.UserSid}
+	for _, kind := range p.Fields() {
+		parts = append(parts, string(kind)+"="+p.Get(kind))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func (c *CachedValidator) Validate(r *http.Request, a AuthenticationPayload, p ValidatePayload) (ValidateResponse, error) {
+	key := validationCacheKey(a, p)
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*validationCacheEntry)
+		if c.now().Before(e.expiresAt) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.response, nil
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	res, err := c.Validator.Validate(r, a, p)
+	if err != nil || transientValidationError(res, p) {
+		return res, err
+	}
+	ttl := c.Options.TTL
+	if res.HasErrors(p) {
+		ttl = c.Options.NegativeTTL
+	}
+	if ttl > 0 {
+		c.store(key, res, ttl)
+	}
+	return res, nil
+}
+
+// Returns true if any field set in the payload holds an error that may not be there on the next attempt.
+func transientValidationError(res ValidateResponse, p ValidatePayload) bool {
+	for _, d := range FieldDescriptors {
+		if *d.payload(&p) == "" {
+			continue
+		}
+		if e := d.responseError(&res); e != nil && (e.StatusCode == 0 || e.StatusCode >= http.StatusInternalServerError) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CachedValidator) store(key string, res ValidateResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*validationCacheEntry)
+		e.response = res
+		e.expiresAt = c.now().Add(ttl)
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&validationCacheEntry{key: key, response: res, expiresAt: c.now().Add(ttl)})
+	for c.lru.Len() > c.Options.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*validationCacheEntry).key)
+	}
+}
+
+// Removes all cached results.
+func (c *CachedValidator) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
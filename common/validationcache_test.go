@@ -0,0 +1,81 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedValidator(t *testing.T) {
+	v := &countingValidator{}
+	c := NewCachedValidator(v, ValidationCacheOptions{TTL: time.Minute, NegativeTTL: 10 * time.Second, MaxEntries: 2})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	jane := AuthenticationPayload{ClientId: "c", UserName: "jane"}
+	john := AuthenticationPayload{ClientId: "c", UserName: "john"}
+
+	res, err := c.Validate(nil, jane, ValidatePayload{CaseID: "C1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "C1", res.CaseID.ID)
+	c.Validate(nil, jane, ValidatePayload{CaseID: "C1"})
+	assert.Len(t, v.calls, 1)
+
+	// The identity is part of the key
+	c.Validate(nil, john, ValidatePayload{CaseID: "C1"})
+	assert.Len(t, v.calls, 2)
+
+	// Negative results are cached with their own TTL
+	c.Purge()
+	v.calls = nil
+	res, _ = c.Validate(nil, jane, ValidatePayload{CaseID: "unknown"})
+	assert.NotNil(t, res.CaseID.Error)
+	c.Validate(nil, jane, ValidatePayload{CaseID: "unknown"})
+	assert.Len(t, v.calls, 1)
+	now = now.Add(11 * time.Second)
+	c.Validate(nil, jane, ValidatePayload{CaseID: "unknown"})
+	c.Validate(nil, jane, ValidatePayload{CaseID: "C1"})
+	assert.Len(t, v.calls, 3)
+	now = now.Add(30 * time.Second)
+	c.Validate(nil, jane, ValidatePayload{CaseID: "C1"})
+	assert.Len(t, v.calls, 3)
+	now = now.Add(31 * time.Second)
+	c.Validate(nil, jane, ValidatePayload{CaseID: "C1"})
+	assert.Len(t, v.calls, 4)
+
+	// Errors are never cached
+	v.calls = nil
+	_, err = c.Validate(nil, jane, ValidatePayload{CaseID: "broken"})
+	assert.Error(t, err)
+	c.Validate(nil, jane, ValidatePayload{CaseID: "broken"})
+	assert.Len(t, v.calls, 2)
+
+	// Nor are field-errors that may be transient
+	v.calls = nil
+	for _, id := range []string{"unavailable", "unspecified"} {
+		res, _ = c.Validate(nil, jane, ValidatePayload{CaseID: id})
+		assert.NotNil(t, res.CaseID.Error)
+		c.Validate(nil, jane, ValidatePayload{CaseID: id})
+	}
+	assert.Len(t, v.calls, 4)
+
+	// Least recently used entries are evicted
+	c.Purge()
+	v.calls = nil
+	c.Validate(nil, jane, ValidatePayload{CaseID: "A"})
+	c.Validate(nil, jane, ValidatePayload{CaseID: "B"})
+	c.Validate(nil, jane, ValidatePayload{CaseID: "A"})
+	c.Validate(nil, jane, ValidatePayload{CaseID: "C"})
+	c.Validate(nil, jane, ValidatePayload{CaseID: "A"})
+	assert.Len(t, v.calls, 3)
+	c.Validate(nil, jane, ValidatePayload{CaseID: "B"})
+	assert.Len(t, v.calls, 4)
+}
+
+func TestCachedValidatorNegativeDisabled(t *testing.T) {
+	v := &countingValidator{}
+	c := NewCachedValidator(v, ValidationCacheOptions{TTL: time.Minute})
+	c.Validate(nil, AuthenticationPayload{}, ValidatePayload{CaseID: "unknown"})
+	c.Validate(nil, AuthenticationPayload{}, ValidatePayload{CaseID: "unknown"})
+	assert.Len(t, v.calls, 2)
+}
@@ -1,10 +1,22 @@
 module github.com/indicosystems/proxy-common
 
-go 1.16
+go 1.20
 
 require (
 	github.com/go-test/deep v1.0.6
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.5.1
 	github.com/tus/tusd v1.3.0
+	golang.org/x/crypto v0.29.0
+)
+
+require (
+	github.com/aws/aws-sdk-go v1.20.1 // indirect
+	github.com/bmizerany/pat v0.0.0-20170815010413-6226ea591a40 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.27.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
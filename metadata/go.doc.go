@@ -41,7 +41,9 @@
 //	}
 //
 // The size of each chunk can be set by the client, but we recommend at least 6 MB. Each chunk can optionally be
-// verified by providing the checksum of the current chunk.
+// verified by providing the checksum of the current chunk in the `Upload-Checksum`-header, as described by the
+// checksum-extension of the TUS-protocol. Supported algorithms are sha1, sha256 and md5. A chunk that fails
+// verification is rejected with the status-code 460, and must be resent.
 //
 // POST-ing metadata as JSON to `/create`.
 //
@@ -76,5 +78,8 @@
 //
 // Updates are done in the same way as creating files, as described above, but the url is `update`
 //
+// The connector receives the previous and the new metadata, along with the fields that changed. If the backend
+// is unavailable, the update is queued, and the client receives `Queued` as the confirmation.
+//
 //
 package metadata
@@ -24,6 +24,8 @@ const (
 	AsUserName               = "as-username"
 	AsUserId                 = "as-user-id"
 	AsUserActiveDirectorySid = "as-user-sid"
+	// Set by the server when quota is reserved for the upload
+	QuotaUploadId = "quota-upload-id"
 
 	// The name of the container the file belongs to.
 	ParentName        = "parentname"
@@ -61,6 +63,7 @@ const (
 	MUploadMetadata                   = "UploadMetadata"
 	ClientMessages                    = "ClientMessages"
 	CaseNumberIgnored InternalInfoStr = "CaseNumberIgnored"
+	MimeMismatch      InternalInfoStr = "MimeMismatch"
 	_true                             = "true"
 	_false                            = "false"
 )